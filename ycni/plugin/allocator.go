@@ -0,0 +1,285 @@
+package main
+
+import (
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+	"github.com/pkg/errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 内置的ipam直接复用host-local的分配逻辑和磁盘存储，目录、文件格式和文件锁都和host-local一致，
+// 两者之间切换不需要迁移数据，也不用每次ADD/DEL都fork一个host-local进程
+const (
+	ycniIPAMType = "ycni"
+	// 和host-local的默认存储目录一致
+	defaultIPAMDataDir = "/var/lib/cni/networks"
+	// 等待存储锁的超时时间，大量pod同时创建时超时让runtime稍后重试，不让kubelet一直卡住
+	ipamLockTimeout = 10 * time.Second
+)
+
+// lockedStore 调用方已经持有存储锁，allocator.Get里的加锁和解锁不再操作文件锁，
+// 多个range set在同一把锁里分配
+type lockedStore struct {
+	*disk.Store
+}
+
+func (s lockedStore) Lock() error {
+	return nil
+}
+
+func (s lockedStore) Unlock() error {
+	return nil
+}
+
+// lockStore 等待存储锁，超时返回稍后重试。
+// flock不支持超时，超时后等锁的goroutine留在后台，插件进程随后就退出了
+func lockStore(store *disk.Store) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Lock()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return errors.Wrap(err, "ipam加锁失败")
+		}
+		return nil
+	case <-time.After(ipamLockTimeout):
+		return tryAgainError(errors.New("ipam加锁超时"), "等待ipam存储锁超时", "timed out waiting for the ipam store lock")
+	}
+}
+
+// allocateIPs 每个RangeSet分配一个ip，requested中有指定ip的range set分配指定的ip，
+// 任意一个失败时把已经分配的释放掉
+func allocateIPs(ipamConf *allocator.Net, requested map[int]net.IP, containerID, ifName string) (*types100.Result, error) {
+	store, err := disk.New(ipamConf.Name, ipamConf.IPAM.DataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "打开ipam存储失败")
+	}
+	defer store.Close()
+
+	// 整个分配过程持有存储目录的文件锁，并发的ADD之间不会分到同一个ip
+	if err = lockStore(store); err != nil {
+		return nil, err
+	}
+	defer store.Unlock()
+	result := &types100.Result{CNIVersion: types100.ImplementedSpecVersion}
+	for idx := range ipamConf.IPAM.Ranges {
+		rangeSet := &ipamConf.IPAM.Ranges[idx]
+		if err = rangeSet.Canonicalize(); err != nil {
+			return nil, errors.Wrapf(err, "ipam range配置错误: %s", rangeSet.String())
+		}
+		// 分配和占用检查在同一把文件锁里完成，指定的ip已被占用时直接失败
+		ipConf, err := allocator.NewIPAllocator(rangeSet, lockedStore{store}, idx).Get(containerID, ifName, requested[idx])
+		if err != nil {
+			if releaseErr := store.ReleaseByID(containerID, ifName); releaseErr != nil {
+				return nil, errors.Wrapf(err, "分配ip失败, 释放已分配的ip也失败: %s", releaseErr.Error())
+			}
+			if requested[idx] != nil {
+				return nil, errors.Wrapf(err, "分配指定的ip %s 失败，可能已经被占用", requested[idx])
+			}
+			return nil, errors.Wrapf(err, "分配ip失败")
+		}
+		result.IPs = append(result.IPs, ipConf)
+	}
+	return result, nil
+}
+
+// releaseIPs 释放容器的所有ip，没有分配记录时不报错
+func releaseIPs(ipamConf *allocator.Net, containerID, ifName string) error {
+	store, err := disk.New(ipamConf.Name, ipamConf.IPAM.DataDir)
+	if err != nil {
+		return errors.Wrap(err, "打开ipam存储失败")
+	}
+	defer store.Close()
+	return releaseByID(store, containerID, ifName)
+}
+
+func releaseByID(store *disk.Store, containerID, ifName string) error {
+	if err := lockStore(store); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	if err := store.ReleaseByID(containerID, ifName); err != nil {
+		return errors.Wrap(err, "释放ip失败")
+	}
+	return nil
+}
+
+// ipamAllocation 存储目录中一个容器网卡分配到的ip
+type ipamAllocation struct {
+	containerID string
+	ifName      string
+	ips         []net.IP
+}
+
+// ipNets 和宿主机上到pod的路由一样，ipv4是/32，ipv6是/128
+func (a *ipamAllocation) ipNets() []net.IPNet {
+	var ipNets []net.IPNet
+	for _, addr := range a.ips {
+		if v4 := addr.To4(); v4 != nil {
+			ipNets = append(ipNets, net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			ipNets = append(ipNets, net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	return ipNets
+}
+
+// listAllocations 读取存储目录中所有的分配记录，文件名是ip，内容是容器id和网卡名
+func listAllocations(ipamConf *allocator.Net) (map[string]*ipamAllocation, error) {
+	store, err := disk.New(ipamConf.Name, ipamConf.IPAM.DataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "打开ipam存储失败")
+	}
+	defer store.Close()
+	if err = store.Lock(); err != nil {
+		return nil, errors.Wrap(err, "ipam加锁失败")
+	}
+	defer store.Unlock()
+
+	dir := ipamConf.IPAM.DataDir
+	if dir == "" {
+		dir = defaultIPAMDataDir
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, ipamConf.Name))
+	if err != nil {
+		return nil, errors.Wrap(err, "读取ipam存储目录失败")
+	}
+	allocations := map[string]*ipamAllocation{}
+	for _, entry := range entries {
+		// 目录里还有lock和last_reserved_ip文件
+		addr := net.ParseIP(entry.Name())
+		if entry.IsDir() || addr == nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, ipamConf.Name, entry.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "读取ip分配记录失败: %s", entry.Name())
+		}
+		// 老版本的host-local只记录了容器id
+		parts := strings.SplitN(strings.TrimSpace(string(data)), disk.LineBreak, 2)
+		a := &ipamAllocation{containerID: parts[0]}
+		if len(parts) == 2 {
+			a.ifName = parts[1]
+		}
+		key := attachmentKey(a.containerID, a.ifName)
+		if allocations[key] == nil {
+			allocations[key] = a
+		}
+		allocations[key].ips = append(allocations[key].ips, addr)
+	}
+	return allocations, nil
+}
+
+// allocatedPodIPs 从分配记录中找出容器网卡的ip，只支持内置ipam和host-local，找不到时返回空
+func allocatedPodIPs(ycniConf *YCNIConfig, containerID, ifName string) ([]net.IPNet, error) {
+	if ycniConf.IPAM.Type != ycniIPAMType && ycniConf.IPAM.Type != "host-local" {
+		return nil, nil
+	}
+	ipamConf, err := buildIPAMConf(ycniConf)
+	if err != nil {
+		return nil, err
+	}
+	allocations, err := listAllocations(ipamConf)
+	if err != nil {
+		return nil, err
+	}
+	if a := allocations[attachmentKey(containerID, ifName)]; a != nil {
+		return a.ipNets(), nil
+	}
+	return nil, nil
+}
+
+// releaseAllocation 加锁后按记录内容删除，期间被重新分配给别的容器的ip内容已经变了，不会被误删
+func releaseAllocation(ipamConf *allocator.Net, a *ipamAllocation) error {
+	store, err := disk.New(ipamConf.Name, ipamConf.IPAM.DataDir)
+	if err != nil {
+		return errors.Wrap(err, "打开ipam存储失败")
+	}
+	defer store.Close()
+	if err = store.Lock(); err != nil {
+		return errors.Wrap(err, "ipam加锁失败")
+	}
+	defer store.Unlock()
+	match := a.containerID
+	if a.ifName != "" {
+		match += disk.LineBreak + a.ifName
+	}
+	if _, err = store.ReleaseByKey(match); err != nil {
+		return errors.Wrapf(err, "释放ip失败: %s", a.containerID)
+	}
+	return nil
+}
+
+// checkStoreWritable 在存储目录里写一个临时文件，磁盘满或者只读时ADD一定会失败
+func checkStoreWritable(ipamConf *allocator.Net) error {
+	store, err := disk.New(ipamConf.Name, ipamConf.IPAM.DataDir)
+	if err != nil {
+		return errors.Wrap(err, "打开ipam存储失败")
+	}
+	defer store.Close()
+	dir := ipamConf.IPAM.DataDir
+	if dir == "" {
+		dir = defaultIPAMDataDir
+	}
+	// 文件名不是ip，不会被当成分配记录
+	f, err := os.CreateTemp(filepath.Join(dir, ipamConf.Name), "status.")
+	if err != nil {
+		return errors.Wrap(err, "ipam存储目录不可写")
+	}
+	name := f.Name()
+	_, err = f.WriteString("status")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(name); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "ipam存储目录不可写")
+	}
+	return nil
+}
+
+// exhaustedRangeSet 返回第一个没有空闲ip的range set，都有空闲时返回nil。
+// 每个range set都要分配一个ip，任意一个满了ADD都会失败
+func exhaustedRangeSet(ipamConf *allocator.Net, allocations map[string]*ipamAllocation) (*allocator.RangeSet, error) {
+	for idx := range ipamConf.IPAM.Ranges {
+		rangeSet := &ipamConf.IPAM.Ranges[idx]
+		if err := rangeSet.Canonicalize(); err != nil {
+			return nil, errors.Wrapf(err, "ipam range配置错误: %s", rangeSet.String())
+		}
+		capacity := big.NewInt(0)
+		for _, r := range *rangeSet {
+			size := new(big.Int).Sub(new(big.Int).SetBytes(r.RangeEnd.To16()), new(big.Int).SetBytes(r.RangeStart.To16()))
+			size.Add(size, big.NewInt(1))
+			// 网关不参与分配
+			if r.Gateway != nil && r.Contains(r.Gateway) {
+				size.Sub(size, big.NewInt(1))
+			}
+			capacity.Add(capacity, size)
+		}
+		used := int64(0)
+		for _, a := range allocations {
+			for _, addr := range a.ips {
+				if rangeSet.Contains(addr) {
+					used++
+				}
+			}
+		}
+		if capacity.Cmp(big.NewInt(used)) <= 0 {
+			return rangeSet, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"math"
+	"net"
+	"syscall"
+)
+
+// pod入方向(宿主机发往pod)在hostVeth的root上挂tbf限速，
+// pod出方向在hostVeth的ingress上把流量重定向到ifb设备，再在ifb的root上挂tbf限速
+const (
+	ingressBandwidthAnnotationKey = "kubernetes.io/ingress-bandwidth"
+	egressBandwidthAnnotationKey  = "kubernetes.io/egress-bandwidth"
+	// tbf队列的最大排队延迟，和社区bandwidth插件一致
+	tbfLatencyInMillis = 25
+	// 注解里只有速率，burst按100ms的流量计算，不小于64KB
+	minBurstInBits = 64 * 1024 * 8
+)
+
+// podBandwidth 获取pod的限速配置，优先使用bandwidth capability，其次是pod注解，都没有时返回nil
+func podBandwidth(ycniConf *YCNIConfig, pod *v1.Pod) (*BandwidthEntry, error) {
+	bw := ycniConf.RuntimeConfig.Bandwidth
+	if bw == nil && pod != nil {
+		ingressRate, err := parseBandwidthAnnotation(pod, ingressBandwidthAnnotationKey)
+		if err != nil {
+			return nil, err
+		}
+		egressRate, err := parseBandwidthAnnotation(pod, egressBandwidthAnnotationKey)
+		if err != nil {
+			return nil, err
+		}
+		bw = &BandwidthEntry{
+			IngressRate:  ingressRate,
+			IngressBurst: defaultBurst(ingressRate),
+			EgressRate:   egressRate,
+			EgressBurst:  defaultBurst(egressRate),
+		}
+	}
+	if bw == nil || (bw.IngressRate == 0 && bw.EgressRate == 0) {
+		return nil, nil
+	}
+	if err := validateRateAndBurst(bw.IngressRate, bw.IngressBurst); err != nil {
+		return nil, errors.Wrap(err, "入方向限速配置错误")
+	}
+	if err := validateRateAndBurst(bw.EgressRate, bw.EgressBurst); err != nil {
+		return nil, errors.Wrap(err, "出方向限速配置错误")
+	}
+	return bw, nil
+}
+
+// parseBandwidthAnnotation 注解的值是k8s的Quantity格式，例如10M，单位是bit/s
+func parseBandwidthAnnotation(pod *v1.Pod, key string) (uint64, error) {
+	value := pod.Annotations[key]
+	if value == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "解析pod注解%s失败: %s", key, value)
+	}
+	if q.Value() <= 0 {
+		return 0, errors.Errorf("pod注解%s必须大于0: %s", key, value)
+	}
+	return uint64(q.Value()), nil
+}
+
+func defaultBurst(rate uint64) uint64 {
+	if rate == 0 {
+		return 0
+	}
+	if burst := rate / 10; burst > minBurstInBits {
+		return burst
+	}
+	return minBurstInBits
+}
+
+func validateRateAndBurst(rate, burst uint64) error {
+	switch {
+	case burst == 0 && rate != 0:
+		return errors.New("配置了rate时必须配置burst")
+	case rate == 0 && burst != 0:
+		return errors.New("配置了burst时必须配置rate")
+	case burst/8 >= math.MaxUint32:
+		return errors.New("burst不能超过4GB")
+	}
+	return nil
+}
+
+// ifbNameForVeth ifb设备名由hostVeth名生成，del时不需要额外记录
+func ifbNameForVeth(hostVethName string) string {
+	h := sha1.New()
+	h.Write([]byte(hostVethName))
+	return fmt.Sprintf("%s%s", "ifb", hex.EncodeToString(h.Sum(nil))[:11])
+}
+
+// setupBandwidth 在hostVeth和ifb上配置限速
+func setupBandwidth(hostVeth netlink.Link, bw *BandwidthEntry) error {
+	if bw.IngressRate > 0 {
+		if err := netlink.QdiscAdd(tbfQdisc(bw.IngressRate, bw.IngressBurst, hostVeth.Attrs().Index)); err != nil {
+			return errors.Wrap(err, "hostVeth添加tbf失败")
+		}
+	}
+	if bw.EgressRate == 0 {
+		return nil
+	}
+
+	ifbName := ifbNameForVeth(hostVeth.Attrs().Name)
+	if err := netlink.LinkAdd(&netlink.Ifb{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:  ifbName,
+			Flags: net.FlagUp,
+			MTU:   hostVeth.Attrs().MTU,
+		},
+	}); err != nil {
+		return errors.Wrapf(err, "创建ifb设备失败: %s", ifbName)
+	}
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		return errors.Wrapf(err, "没找到ifb设备: %s", ifbName)
+	}
+
+	// tc qdisc add dev <hostVeth> handle ffff: ingress
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err = netlink.QdiscAdd(ingress); err != nil {
+		return errors.Wrap(err, "hostVeth添加ingress队列失败")
+	}
+	// 把hostVeth收到的包(pod发出的包)重定向到ifb
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Parent:    ingress.QdiscAttrs.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifb.Attrs().Index,
+		Actions: []netlink.Action{
+			&netlink.MirredAction{
+				MirredAction: netlink.TCA_EGRESS_REDIR,
+				Ifindex:      ifb.Attrs().Index,
+			},
+		},
+	}
+	if err = netlink.FilterAdd(filter); err != nil {
+		return errors.Wrap(err, "hostVeth添加重定向规则失败")
+	}
+	if err = netlink.QdiscAdd(tbfQdisc(bw.EgressRate, bw.EgressBurst, ifb.Attrs().Index)); err != nil {
+		return errors.Wrap(err, "ifb添加tbf失败")
+	}
+	return nil
+}
+
+// teardownBandwidth hostVeth上的队列随veth一起删除，只需要删ifb
+func teardownBandwidth(hostVethName string) error {
+	if err := ip.DelLinkByName(ifbNameForVeth(hostVethName)); err != nil && err != ip.ErrLinkNotFound {
+		return errors.Wrap(err, "删除ifb设备失败")
+	}
+	return nil
+}
+
+// checkBandwidth 检查hostVeth和ifb上的tbf参数和配置一致
+func checkBandwidth(hostVethName string, bw *BandwidthEntry) error {
+	if bw == nil {
+		return nil
+	}
+	if bw.IngressRate > 0 {
+		hostVeth, err := netlink.LinkByName(hostVethName)
+		if err != nil {
+			return linkError(err, fmt.Sprintf("没有找到hostVeth: %s", hostVethName), "host veth not found")
+		}
+		if err = checkTBF(hostVeth, tbfQdisc(bw.IngressRate, bw.IngressBurst, hostVeth.Attrs().Index)); err != nil {
+			return err
+		}
+	}
+	if bw.EgressRate > 0 {
+		ifbName := ifbNameForVeth(hostVethName)
+		ifb, err := netlink.LinkByName(ifbName)
+		if err != nil {
+			return driftError(err, fmt.Sprintf("没有找到ifb设备: %s", ifbName), "ifb device not found")
+		}
+		if err = checkTBF(ifb, tbfQdisc(bw.EgressRate, bw.EgressBurst, ifb.Attrs().Index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkTBF(link netlink.Link, want *netlink.Tbf) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return internalError(err, "获取队列失败", "failed to list qdiscs")
+	}
+	for _, q := range qdiscs {
+		tbf, ok := q.(*netlink.Tbf)
+		if !ok || tbf.Attrs().Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		if tbf.Rate != want.Rate || tbf.Limit != want.Limit || tbf.Buffer != want.Buffer {
+			return driftError(fmt.Errorf("rate: %d, limit: %d, buffer: %d", tbf.Rate, tbf.Limit, tbf.Buffer),
+				fmt.Sprintf("%s上的tbf参数和配置不一致", link.Attrs().Name), "tbf qdisc does not match bandwidth limits")
+		}
+		return nil
+	}
+	return driftError(nil, fmt.Sprintf("%s上没有tbf队列", link.Attrs().Name), "tbf qdisc not found on "+link.Attrs().Name)
+}
+
+// tbfQdisc 和tc qdisc add dev <link> root tbf rate <rate> burst <burst> latency 25ms一样
+func tbfQdisc(rateInBits, burstInBits uint64, linkIndex int) *netlink.Tbf {
+	rateInBytes := rateInBits / 8
+	burstInBytes := uint32(burstInBits / 8)
+	latency := float64(netlink.TIME_UNITS_PER_SEC) * (tbfLatencyInMillis / 1000.0)
+	buffer := uint32(float64(uint32(float64(burstInBytes)*float64(netlink.TIME_UNITS_PER_SEC)/float64(rateInBytes))) * netlink.TickInUsec())
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Limit:  uint32(float64(rateInBytes)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + burstInBytes,
+		Rate:   rateInBytes,
+		Buffer: buffer,
+	}
+}
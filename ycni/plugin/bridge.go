@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// 默认是路由模式: pod是/32地址，网关169.254.1.1，宿主机veth做arp代理。
+// 网桥模式下宿主机veth接到节点的网桥上，网桥上配置pod子网的网关，pod之间二层互通
+const (
+	modeRouted = "routed"
+	modeBridge = "bridge"
+	// 和ycnid创建的网桥同名
+	defaultBridgeName = "ycnibr0"
+)
+
+func (c *YCNIConfig) bridgeMode() bool {
+	return c.Mode == modeBridge
+}
+
+func (c *YCNIConfig) bridgeName() string {
+	if c.Bridge != "" {
+		return c.Bridge
+	}
+	return defaultBridgeName
+}
+
+// validateMode 为空时是路由模式
+func validateMode(ycniConf *YCNIConfig) error {
+	switch ycniConf.Mode {
+	case "", modeRouted, modeBridge:
+		return nil
+	default:
+		return errors.Errorf("不支持的模式: %s", ycniConf.Mode)
+	}
+}
+
+// podGateways pod每个地址族的默认网关，没有对应地址族时为nil
+type podGateways struct {
+	v4 net.IP
+	v6 net.IP
+}
+
+func (g podGateways) contains(gw net.IP) bool {
+	return (g.v4 != nil && gw.Equal(g.v4)) || (g.v6 != nil && gw.Equal(g.v6))
+}
+
+// routedGateways 路由模式下的网关是宿主机veth代答的链路本地地址
+func routedGateways(hasIpv4, hasIpv6 bool) podGateways {
+	var gws podGateways
+	if hasIpv4 {
+		gws.v4 = defaultPodGw
+	}
+	if hasIpv6 {
+		gws.v6 = defaultPodGw6
+	}
+	return gws
+}
+
+// bridgeGateways 网桥模式下的网关是ipam分配的子网网关，也就是网桥上的地址
+func bridgeGateways(ips []*types100.IPConfig) (podGateways, []*net.IPNet, error) {
+	var gws podGateways
+	var bridgeAddrs []*net.IPNet
+	for _, ipc := range ips {
+		if ipc.Gateway == nil {
+			return gws, nil, errors.Errorf("ipam没有返回网关: %s", ipc.Address.String())
+		}
+		if ipc.Address.IP.To4() != nil {
+			gws.v4 = ipc.Gateway
+		} else {
+			gws.v6 = ipc.Gateway
+		}
+		bridgeAddrs = append(bridgeAddrs, &net.IPNet{IP: ipc.Gateway, Mask: ipc.Address.Mask})
+	}
+	return gws, bridgeAddrs, nil
+}
+
+// ensureBridge 网桥不存在时创建，配置网关地址并up，ycnid启动时已经创建好的话这里只做检查。
+// 网关地址所在的直连路由就是宿主机到pod子网的路由
+func ensureBridge(name string, mtu int, gateways []*net.IPNet) (netlink.Link, error) {
+	br, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, errors.Wrapf(err, "获取网桥失败: %s", name)
+		}
+		err = netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}})
+		// 并发的ADD可能已经建好了
+		if err != nil && err != syscall.EEXIST {
+			return nil, errors.Wrapf(err, "创建网桥失败: %s", name)
+		}
+		if br, err = netlink.LinkByName(name); err != nil {
+			return nil, errors.Wrapf(err, "获取网桥失败: %s", name)
+		}
+	}
+	if _, ok := br.(*netlink.Bridge); !ok {
+		return nil, errors.Errorf("%s不是网桥: %s", name, br.Type())
+	}
+
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "获取网桥地址失败: %s", name)
+	}
+	for _, gw := range gateways {
+		if hasAddr(addrs, gw) {
+			continue
+		}
+		addr := &netlink.Addr{IPNet: gw}
+		if gw.IP.To4() == nil {
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err = netlink.AddrAdd(br, addr); err != nil && err != syscall.EEXIST {
+			return nil, errors.Wrapf(err, "网桥配置地址失败: %s", gw.String())
+		}
+	}
+	if err = netlink.LinkSetUp(br); err != nil {
+		return nil, errors.Wrapf(err, "网桥up失败: %s", name)
+	}
+	return br, nil
+}
+
+// attachToBridge 开启hairpin，pod通过hostPort访问自己时dnat后的包要从同一个端口发回去
+func attachToBridge(hostVeth, br netlink.Link) error {
+	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
+		return errors.Wrapf(err, "把hostVeth接到网桥失败: %s", br.Attrs().Name)
+	}
+	if err := netlink.LinkSetHairpin(hostVeth, true); err != nil {
+		return errors.Wrap(err, "开启hairpin失败")
+	}
+	return nil
+}
+
+// checkBridgePort 网桥模式下检查hostVeth是否还接在网桥上
+func checkBridgePort(hostVeth netlink.Link, bridgeName string) error {
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return driftError(err, fmt.Sprintf("没有找到网桥: %s", bridgeName), "bridge not found")
+	}
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		return driftError(cniDetail(bridgeName), "网桥未up", "bridge is down")
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return driftError(cniDetail(hostVeth.Attrs().Name), "hostVeth没有接在网桥上", "host veth is not attached to the bridge")
+	}
+	return nil
+}
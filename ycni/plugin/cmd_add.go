@@ -1,51 +1,47 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ip"
-	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"net"
 	"ycni/log"
 )
 
+const (
+	// 配置中没有指定mtu时使用
+	defaultMTU = 1500
+)
+
 var (
-	defaultOutInterface   = "eth0"
 	defaultHostVethMac, _ = net.ParseMAC("EE:EE:EE:EE:EE:EE")
 	defaultPodGw          = net.IPv4(169, 254, 1, 1)
 	defaultGwIPNet        = &net.IPNet{IP: defaultPodGw, Mask: net.CIDRMask(32, 32)}
-	_, IPv4AllNet, _      = net.ParseCIDR("0.0.0.0/0")
-	defaultRoutes         = []*net.IPNet{IPv4AllNet}
+	// ipv6的网关用链路本地地址，宿主机veth上通过proxy ndp应答
+	defaultPodGw6    = net.ParseIP("fe80::1")
+	defaultGwIPNet6  = &net.IPNet{IP: defaultPodGw6, Mask: net.CIDRMask(128, 128)}
+	_, IPv4AllNet, _ = net.ParseCIDR("0.0.0.0/0")
+	_, IPv6AllNet, _ = net.ParseCIDR("::/0")
+	defaultRoutes    = []*net.IPNet{IPv4AllNet, IPv6AllNet}
 )
 
-type IPAM struct {
-	Type       string `json:"type"`
-	Subnet     string `json:"subnet"`
-	RangeStart string `json:"rangeStart"`
-	RangeEnd   string `json:"rangeEnd"`
-}
-
-type YCNIConfig struct {
-	CNIVersion string `json:"cniVersion"`
-	Name       string `json:"name"`
-	Type       string `json:"type"`
-	IPAM       IPAM   `json:"ipam"`
-}
-
 type cniArgs struct {
 	namespace   string
 	podName     string
 	containerID string
+	// CNI_ARGS中指定的ip
+	ip string
+	// CNI_ARGS中覆盖的路由
+	routes string
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	log.Debugf("cmdAdd containerID: %s", args.ContainerID)
 	log.Debugf("cmdAdd netNs: %s", args.Netns)
 	log.Debugf("cmdAdd ifName: %s", args.IfName)
@@ -61,12 +57,10 @@ func cmdAdd(args *skel.CmdArgs) error {
 		cmdAdd path: /opt/cni/bin
 		cmdAdd stdin: {"cniVersion":"0.3.1","ipam":{"subnet":"10.244.0.0/24","type":"host-local"},"name":"ycni0","type":"ycni"}
 	*/
-	var err error
-	var ycniConf YCNIConfig
-	err = json.Unmarshal(args.StdinData, &ycniConf)
+	ycniConf, err := loadConf(args.StdinData)
 	if err != nil {
 		log.Debugf("加载cni配置文件错误: %s", err.Error())
-		return errors.Wrap(err, "加载cni配置文件错误")
+		return err
 	}
 
 	// 解析args  todo
@@ -77,64 +71,101 @@ func cmdAdd(args *skel.CmdArgs) error {
 			containerID string
 		}
 	*/
+	if err = validateMode(ycniConf); err != nil {
+		log.Debugf("模式配置错误: %s", err.Error())
+		return invalidConfigError(err, "模式配置错误", "invalid mode")
+	}
+	if err = validateInterfaceType(ycniConf); err != nil {
+		log.Debugf("网卡类型配置错误: %s", err.Error())
+		return invalidConfigError(err, "网卡类型配置错误", "invalid interface type")
+	}
+
 	cniargs := parseArgs(args.Args)
 
-	// 给ns加上ip  利用ipam插件分配ip
-	// parse子网
-	ipNet, err := types.ParseCIDR(ycniConf.IPAM.Subnet)
+	pod, err := getPod(ycniConf, cniargs)
 	if err != nil {
-		return errors.Wrap(err, "parse子网失败")
-	}
-	var startIp, endIp net.IP
-	if ycniConf.IPAM.RangeStart != "" {
-		startIp = net.ParseIP(ycniConf.IPAM.RangeStart)
-		if startIp == nil {
-			return errors.Wrap(err, "获取起始ip失败")
-		}
-	}
-	if ycniConf.IPAM.RangeEnd != "" {
-		endIp = net.ParseIP(ycniConf.IPAM.RangeEnd)
-		if endIp == nil {
-			return errors.Wrap(err, "获取结束ip失败")
-		}
-	}
-	// 获取ipam配置传给ipam插件
-	ipamConf := allocator.Net{
-		Name:       ycniConf.Name,
-		CNIVersion: ycniConf.CNIVersion,
-		IPAM: &allocator.IPAMConfig{
-			Type: ycniConf.IPAM.Type,
-			Ranges: []allocator.RangeSet{
-				{
-					{
-						Subnet:     types.IPNet(*ipNet),
-						RangeStart: startIp,
-						RangeEnd:   endIp,
-					},
-				},
-			},
-		},
+		log.Debugf("获取pod信息失败: %s", err.Error())
+		return podLookupError(err)
 	}
-	ipamConfBytes, err := json.Marshal(ipamConf)
+	requested, err := requestedIPs(ycniConf, cniargs, pod)
 	if err != nil {
-		return errors.Wrap(err, "获取ipam配置失败")
+		log.Debugf("解析指定的ip失败: %s", err.Error())
+		return invalidConfigError(err, "解析指定的ip失败", "invalid requested IP address")
 	}
-	log.Debugf("ipam配置：%s", string(ipamConfBytes))
-	ipamResult, err := ipam.ExecAdd(ycniConf.IPAM.Type, ipamConfBytes)
+	routes, err := podRoutes(ycniConf, cniargs, pod)
 	if err != nil {
-		log.Debugf("分配ip失败: %s", err.Error())
-		return errors.Wrap(err, "给ns分配ip失败")
+		log.Debugf("解析路由失败: %s", err.Error())
+		return invalidConfigError(err, "解析路由失败", "invalid pod routes")
+	}
+	bw, err := podBandwidth(ycniConf, pod)
+	if err != nil {
+		log.Debugf("解析限速配置失败: %s", err.Error())
+		return invalidConfigError(err, "解析限速配置失败", "invalid bandwidth limits")
+	}
+	// 限速的tbf和ifb挂在hostVeth上，ipvlan和macvlan没有hostVeth
+	if bw != nil && ycniConf.shimMode() {
+		return invalidConfigError(cniDetail(ycniConf.interfaceType()), "限速只支持veth", "bandwidth shaping requires interfaceType veth")
+	}
+	mappings, err := parsePortMappings(ycniConf.RuntimeConfig.PortMappings)
+	if err != nil {
+		log.Debugf("解析端口映射失败: %s", err.Error())
+		return invalidConfigError(err, "解析端口映射失败", "invalid port mappings")
+	}
+	sysctls, err := podSysctls(ycniConf, pod)
+	if err != nil {
+		log.Debugf("解析sysctl失败: %s", err.Error())
+		return invalidConfigError(err, "解析sysctl失败", "invalid container sysctls")
 	}
-	// 获取具体的ipam result
-	result, err := types100.GetResult(ipamResult)
+
+	// statefulset的pod优先拿回之前保留的ip，其他pod保留的ip不参与分配
+	owner := stickyOwner(ycniConf, pod)
+	sticky, reserved, err := stickyIPs(ycniConf, owner)
 	if err != nil {
-		log.Debugf("转换ipam result失败: %s", err.Error())
-		return errors.Wrap(err, "转化ipam result失败")
+		log.Debugf("读取ip保留记录失败: %s", err.Error())
+		return ioError(err, "读取ip保留记录失败", "failed to read sticky IP reservations")
+	}
+	if addr := reservedByOthers(requested, reserved); addr != nil {
+		log.Debugf("指定的ip %s 已经保留给其他statefulset pod", addr)
+		return newCNIError(errCodeIPUnavailable, cniDetail(addr.String()), "指定的ip已经保留给其他statefulset pod", "requested IP address is reserved for sticky pod")
+	}
+	ycniConf.IPAM.Exclude = append(ycniConf.IPAM.Exclude, reserved...)
+
+	// 给ns加上ip  利用ipam分配ip
+	result, err := ipamAdd(ycniConf, args, requested, sticky)
+	if err != nil {
+		log.Debugf("分配ip失败: %s", err.Error())
+		return err
+	}
+
+	// 后续任何一步失败都要把前面已经完成的步骤撤销掉，避免泄漏ip和veth
+	rb := &rollback{}
+	defer func() {
+		if err != nil {
+			log.Debugf("cmdAdd失败, 开始回滚: %s", err.Error())
+			rb.run()
+		}
+	}()
+	rb.add("释放ip", func() error {
+		return ipamDel(ycniConf, args)
+	})
+	if owner != nil {
+		// 保留记录在DEL时不删除，回滚时也保留
+		if err = saveStickyReservation(ycniConf, owner, result); err != nil {
+			log.Debugf("保存ip保留记录失败: %s", err.Error())
+			return ioError(err, "保存ip保留记录失败", "failed to save sticky IP reservation")
+		}
 	}
 
-	// 随机生成veth name
-	hostVethName := vethNameForWorkload(cniargs.namespace, cniargs.namespace)
+	// 按容器id和网卡名生成veth name，记录下来给DEL和CHECK用
+	hostVethName := hostVethNameFor(args, cniargs)
 	log.Debugf("hostVethName: %s", hostVethName)
+	rb.add("删除hostVeth记录", func() error {
+		return removeHostVethName(ycniConf, args)
+	})
+	if err = saveHostVethName(ycniConf, args, hostVethName); err != nil {
+		log.Debugf("保存hostVeth记录失败: %s", err.Error())
+		return ioError(err, "保存hostVeth记录失败", "failed to save host veth name")
+	}
 
 	// 配置 veth pair
 	// 如果老的已存在则删除
@@ -143,56 +174,156 @@ func cmdAdd(args *skel.CmdArgs) error {
 		// 说明已存在
 		err = netlink.LinkDel(oldHostVeth)
 		if err != nil {
-			return errors.Wrapf(err, "删除old hostveth失败: %v", hostVethName)
+			return internalError(err, fmt.Sprintf("删除old hostveth失败: %v", hostVethName), "failed to delete stale host veth")
 		}
 	}
+	if err = teardownBandwidth(hostVethName); err != nil {
+		return internalError(err, fmt.Sprintf("删除old ifb失败: %v", hostVethName), "failed to delete stale ifb device")
+	}
 
-	var hasIpv4 bool
-	ns.WithNetNSPath(args.Netns, func(netNS ns.NetNS) error {
-		// 下面是要在容器中创建的veth
-		veth := &netlink.Veth{
-			LinkAttrs: netlink.LinkAttrs{
-				Name: args.IfName,
-				MTU:  1500,
-			},
-			PeerName: hostVethName,
-		}
-
-		if err := netlink.LinkAdd(veth); err != nil {
-			return errors.Wrapf(err, "在ns中创建veth失败")
-		}
+	mtu := ycniConf.MTU
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
 
-		hostVeth, err := netlink.LinkByName(hostVethName)
-		if err != nil {
-			return errors.Wrapf(err, "没找到对应的veth: %s", hostVethName)
+	var contVethMac string
+	var hasIpv4, hasIpv6 bool
+	for _, addr := range result.IPs {
+		if addr.Address.IP.To4() != nil {
+			hasIpv4 = true
+		} else {
+			hasIpv6 = true
 		}
-
-		if err := netlink.LinkSetHardwareAddr(hostVeth, defaultHostVethMac); err != nil {
-			log.Debugf("failed to Set MAC of %q: %v. Using kernel generated MAC.", hostVethName, err)
+	}
+	// 路由模式下pod是/32和/128地址，网关由宿主机veth代答；网桥模式下保留子网掩码，网关在网桥上
+	var gws podGateways
+	var bridgeAddrs []*net.IPNet
+	if ycniConf.bridgeMode() {
+		if gws, bridgeAddrs, err = bridgeGateways(result.IPs); err != nil {
+			log.Debugf("获取子网网关失败: %s", err.Error())
+			return invalidConfigError(err, "获取子网网关失败", "ipam returned no gateway for bridge mode")
 		}
-
+	} else {
+		gws = routedGateways(hasIpv4, hasIpv6)
 		for _, addr := range result.IPs {
 			if addr.Address.IP.To4() != nil {
-				hasIpv4 = true
 				addr.Address.Mask = net.CIDRMask(32, 32)
+			} else {
+				addr.Address.Mask = net.CIDRMask(128, 128)
 			}
 		}
+	}
+	routes = familyRoutes(routes, gws)
 
-		// up 宿主机上的veth
-		if err = netlink.LinkSetUp(hostVeth); err != nil {
-			return errors.Wrapf(err, "up 宿主机上的veth: %s失败", hostVeth)
+	// ipvlan和macvlan的网卡在宿主机上用hostVethName创建，放到容器ns之后再改名
+	if ycniConf.shimMode() {
+		if err = addPodLink(ycniConf, hostVethName, args.Netns, mtu); err != nil {
+			log.Debugf("创建容器网卡失败: %s", err.Error())
+			return internalError(err, "创建容器网卡失败", "failed to create container interface")
+		}
+		// 和veth一样在网卡建好之后才注册回滚，addPodLink失败时自己会清理。
+		// 改名之前容器ns内的网卡还叫hostVethName
+		rb.add("删除容器网卡", func() error {
+			return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+				if err := ip.DelLinkByName(args.IfName); err != nil {
+					return ip.DelLinkByName(hostVethName)
+				}
+				return nil
+			})
+		})
+	}
+
+	err = ns.WithNetNSPath(args.Netns, func(netNS ns.NetNS) error {
+		var hostVeth netlink.Link
+		var err error
+		if ycniConf.shimMode() {
+			link, err := netlink.LinkByName(hostVethName)
+			if err != nil {
+				return errors.Wrapf(err, "没找到ns内的%s: %s", ycniConf.interfaceType(), hostVethName)
+			}
+			if err = netlink.LinkSetName(link, args.IfName); err != nil {
+				return errors.Wrapf(err, "容器网卡改名失败: %s", args.IfName)
+			}
+		} else {
+			// 下面是要在容器中创建的veth
+			veth := &netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: args.IfName,
+					MTU:  mtu,
+				},
+				PeerName: hostVethName,
+			}
+
+			if err := netlink.LinkAdd(veth); err != nil {
+				return errors.Wrapf(err, "在ns中创建veth失败")
+			}
+			// 删除veth pair的任意一端都会把两端一起删掉，容器内和路由也会随之清理
+			rb.add("删除veth pair", func() error {
+				err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+					return ip.DelLinkByName(args.IfName)
+				})
+				if err != nil {
+					// ns已经不在或者容器内的veth已经被删掉，尝试删宿主机这一端
+					return ip.DelLinkByName(hostVethName)
+				}
+				return nil
+			})
+
+			hostVeth, err = netlink.LinkByName(hostVethName)
+			if err != nil {
+				return errors.Wrapf(err, "没找到对应的veth: %s", hostVethName)
+			}
+
+			// 宿主机这一端的mtu也要保持一致
+			if hostVeth.Attrs().MTU != mtu {
+				if err = netlink.LinkSetMTU(hostVeth, mtu); err != nil {
+					return errors.Wrapf(err, "设置hostVeth mtu失败: %d", mtu)
+				}
+			}
+
+			// 网桥上的端口不能用同一个mac，网桥模式下使用内核生成的mac
+			if !ycniConf.bridgeMode() {
+				if err := netlink.LinkSetHardwareAddr(hostVeth, defaultHostVethMac); err != nil {
+					log.Debugf("failed to Set MAC of %q: %v. Using kernel generated MAC.", hostVethName, err)
+				}
+			}
+
+			// up 宿主机上的veth
+			if err = netlink.LinkSetUp(hostVeth); err != nil {
+				return errors.Wrapf(err, "up 宿主机上的veth: %s失败", hostVeth)
+			}
 		}
 
 		nsVeth, err := netlink.LinkByName(args.IfName)
 		if err != nil {
 			return errors.Wrapf(err, "没找到ns内的veth: %s", args.IfName)
 		}
+		contVethMac = nsVeth.Attrs().HardwareAddr.String()
 		// up 容器内的veth
 		if err = netlink.LinkSetUp(nsVeth); err != nil {
 			return errors.Wrapf(err, "up 容器上上的veth: %s失败", nsVeth)
 		}
 
-		if hasIpv4 {
+		if hasIpv6 {
+			// 容器内可能默认关闭了ipv6
+			if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", args.IfName), "0"); err != nil {
+				return errors.Wrap(err, "容器内开启ipv6失败")
+			}
+		}
+
+		// 先配地址，网桥模式下网关要通过子网的直连路由才能到达
+		for _, addr := range result.IPs {
+			nlAddr := &netlink.Addr{IPNet: &addr.Address}
+			if addr.Address.IP.To4() == nil {
+				// ipv6地址由ipam保证不重复，不需要做重复地址检测，否则要等dad结束才能用
+				nlAddr.Flags = unix.IFA_F_NODAD
+			}
+			if err = netlink.AddrAdd(nsVeth, nlAddr); err != nil {
+				return errors.Wrapf(err, "容器内veth配置ip失败")
+			}
+		}
+
+		if hasIpv4 && !ycniConf.bridgeMode() {
 			// 添加路由 169.254.1.1 dev eth0
 			if err := netlink.RouteAdd(
 				&netlink.Route{
@@ -203,81 +334,249 @@ func cmdAdd(args *skel.CmdArgs) error {
 			); err != nil {
 				return errors.Wrap(err, "容器内添加路由失败")
 			}
+		}
 
-			// 添加默认路由 0.0.0.0/0 via 169.254.1.1 dev eth0
-			for _, r := range defaultRoutes {
-				if r.IP.To4() == nil {
-					continue
-				}
-				if err = ip.AddRoute(r, defaultPodGw, nsVeth); err != nil {
-					return errors.Wrap(err, "容器内添加默认路由失败")
-				}
+		if hasIpv6 && !ycniConf.bridgeMode() {
+			// 添加路由 fe80::1 dev eth0
+			if err := netlink.RouteAdd(
+				&netlink.Route{
+					LinkIndex: nsVeth.Attrs().Index,
+					Scope:     netlink.SCOPE_LINK,
+					Dst:       defaultGwIPNet6,
+				},
+			); err != nil {
+				return errors.Wrap(err, "容器内添加ipv6路由失败")
 			}
 		}
 
-		for _, addr := range result.IPs {
-			if err = netlink.AddrAdd(nsVeth, &netlink.Addr{IPNet: &addr.Address}); err != nil {
-				return errors.Wrapf(err, "容器内veth配置ip失败")
+		// 默认是 0.0.0.0/0 via 169.254.1.1 dev eth0 和 ::/0 via fe80::1 dev eth0，网桥模式下经过子网网关
+		for _, r := range routes {
+			if err = addPodRoute(nsVeth, r, gws); err != nil {
+				return err
 			}
 		}
 
+		if err = applySysctls(sysctls); err != nil {
+			return err
+		}
+
 		// 把hostVeth放入宿主机网络命名空间  需要重新up
-		if err = netlink.LinkSetNsFd(hostVeth, int(netNS.Fd())); err != nil {
-			return errors.Wrapf(err, "把hostveth放到宿主机失败")
+		if hostVeth != nil {
+			if err = netlink.LinkSetNsFd(hostVeth, int(netNS.Fd())); err != nil {
+				return errors.Wrapf(err, "把hostveth放到宿主机失败")
+			}
 		}
 		return nil
 	})
-
-	// 设置arp代理
-	if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", hostVethName), "1"); err != nil {
-		log.Debugf("开启arp代理失败")
-		return errors.Wrap(err, "开启arp代理失败")
+	if err != nil {
+		log.Debugf("配置容器网络失败: %s", err.Error())
+		return netnsError(err, "配置容器网络失败", "failed to configure container interface")
 	}
 
-	// up hostVeth
-	hostVeth, err := netlink.LinkByName(hostVethName)
-	if err != nil {
-		log.Debugf("没有找到hostVeth: %s", hostVethName)
-		return errors.Wrapf(err, "没有找到hostVeth: %s", hostVethName)
+	// hostLink是宿主机上到pod的路由的出口，veth时是hostVeth，ipvlan和macvlan时是shim
+	var hostVeth, hostLink netlink.Link
+	fwdIf := hostVethName
+	if ycniConf.shimMode() {
+		shim, err := ensureShim(ycniConf, mtu, hasIpv4, hasIpv6)
+		if err != nil {
+			log.Debugf("配置shim失败: %s", err.Error())
+			return internalError(err, "配置shim失败", "failed to set up host shim interface")
+		}
+		hostLink = shim
+		fwdIf = shim.Attrs().Name
+	} else {
+		// 设置arp代理
+		if hasIpv4 && !ycniConf.bridgeMode() {
+			if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", hostVethName), "1"); err != nil {
+				log.Debugf("开启arp代理失败")
+				return internalError(err, "开启arp代理失败", "failed to enable proxy_arp on host veth")
+			}
+		}
+
+		// up hostVeth
+		hostVeth, err = netlink.LinkByName(hostVethName)
+		if err != nil {
+			log.Debugf("没有找到hostVeth: %s", hostVethName)
+			return internalError(err, fmt.Sprintf("没有找到hostVeth: %s", hostVethName), "host veth not found")
+		}
+		if err = netlink.LinkSetUp(hostVeth); err != nil {
+			log.Debugf("hostVeth up失败: %s", err.Error())
+			return internalError(err, "hostVeth up失败", "failed to set host veth up")
+		}
+		hostLink = hostVeth
+
+		// 设置ndp代理，宿主机替容器的网关fe80::1应答邻居请求
+		if hasIpv6 && !ycniConf.bridgeMode() {
+			if err = setupProxyNDP(hostVeth); err != nil {
+				log.Debugf("开启ndp代理失败: %s", err.Error())
+				return internalError(err, "开启ndp代理失败", "failed to enable proxy_ndp on host veth")
+			}
+		}
 	}
-	if err = netlink.LinkSetUp(hostVeth); err != nil {
-		log.Debugf("hostVeth up失败: %s", err.Error())
-		return errors.Wrap(err, "hostVeth up失败")
+
+	// 网桥模式下把hostVeth接到网桥上，转发规则按网桥匹配，三层转发时入口和出口网卡都是网桥
+	if ycniConf.bridgeMode() {
+		br, err := ensureBridge(ycniConf.bridgeName(), mtu, bridgeAddrs)
+		if err != nil {
+			log.Debugf("配置网桥失败: %s", err.Error())
+			return internalError(err, "配置网桥失败", "failed to set up bridge")
+		}
+		if err = attachToBridge(hostVeth, br); err != nil {
+			log.Debugf("接入网桥失败: %s", err.Error())
+			return internalError(err, "接入网桥失败", "failed to attach host veth to bridge")
+		}
+		fwdIf = br.Attrs().Name
 	}
 
-	// 配置iptables
-	// 配置forward链
-	Exec("iptables", "-A", "FORWARD", "--out-interface", defaultOutInterface, "--in-interface", hostVethName, "-j", "ACCEPT")
-	Exec("iptables", "-A", "FORWARD", "--out-interface", hostVethName, "--in-interface", defaultOutInterface, "-j", "ACCEPT")
-	// 设置postrouting链
-	Exec("iptables", "-t", "nat", "-A", "POSTROUTING", "--source", ycniConf.IPAM.Subnet, "--out-interface", defaultOutInterface, "-j", "MASQUERADE")
+	// 配置限速，ifb设备不会随veth删除，先注册回滚
+	if bw != nil {
+		rb.add("删除ifb", func() error {
+			return teardownBandwidth(hostVethName)
+		})
+		if err = setupBandwidth(hostVeth, bw); err != nil {
+			log.Debugf("配置限速失败: %s", err.Error())
+			return internalError(err, "配置限速失败", "failed to set up bandwidth shaping")
+		}
+	}
 
-	// 宿主机配置往容器方向的路由
-	for _, ipaddr := range result.IPs {
-		route := netlink.Route{
-			LinkIndex: hostVeth.Attrs().Index,
-			Scope:     netlink.SCOPE_LINK,
-			Dst:       &ipaddr.Address,
+	// 配置转发和masquerade规则
+	dp, err := newDatapath(ycniConf)
+	if err != nil {
+		log.Debugf("初始化datapath失败: %s", err.Error())
+		return invalidConfigError(err, "初始化datapath失败", "failed to initialize datapath")
+	}
+	podIPs := make([]net.IPNet, 0, len(result.IPs))
+	for _, ipc := range result.IPs {
+		podIPs = append(podIPs, ipc.Address)
+	}
+	// 先注册回滚，规则只加了一部分时也能清理掉。网桥的规则其他pod还在用，回滚时按hostVeth删除只会删掉pod自己的
+	rb.add("删除转发规则", func() error {
+		return dp.teardownPod(hostVethName, podIPs)
+	})
+	if err = dp.setupPod(fwdIf, podIPs); err != nil {
+		log.Debugf("配置转发规则失败: %s", err.Error())
+		return internalError(err, "配置转发规则失败", "failed to set up forwarding rules")
+	}
+	if len(mappings) > 0 {
+		rb.add("删除端口映射", func() error {
+			return dp.teardownPortMappings(hostVethName)
+		})
+		if err = dp.setupPortMappings(hostVethName, podIPs, mappings); err != nil {
+			log.Debugf("配置端口映射失败: %s", err.Error())
+			return internalError(err, "配置端口映射失败", "failed to set up port mappings")
 		}
-		if err := netlink.RouteAdd(&route); err != nil {
-			log.Debugf("宿主机添加路由失败 %s", err.Error())
-			return errors.Wrapf(err, "宿主机添加路由失败")
+	}
+
+	// 宿主机配置往容器方向的路由，网桥模式下走网桥上子网的直连路由。
+	// veth删除时路由跟着删除，shim上的路由要单独回滚，shim上还可能残留已经删掉的pod的路由，直接替换
+	addHostRoute := netlink.RouteAdd
+	if ycniConf.shimMode() {
+		addHostRoute = netlink.RouteReplace
+		rb.add("删除shim路由", func() error {
+			return delShimRoutes(ycniConf, podIPs)
+		})
+	}
+	if !ycniConf.bridgeMode() {
+		for _, ipaddr := range result.IPs {
+			route := netlink.Route{
+				LinkIndex: hostLink.Attrs().Index,
+				Scope:     netlink.SCOPE_LINK,
+				Dst:       &ipaddr.Address,
+			}
+			if err := addHostRoute(&route); err != nil {
+				log.Debugf("宿主机添加路由失败 %s", err.Error())
+				return internalError(err, "宿主机添加路由失败", "failed to add host route to pod")
+			}
 		}
 	}
 
+	// 结果中要同时列出宿主机和容器内的网卡，ip通过Interface指向容器内的网卡。
+	// shim是所有pod共用的，ipvlan和macvlan时只列出容器内的网卡
+	result.Interfaces = nil
+	if hostVeth != nil {
+		result.Interfaces = append(result.Interfaces, &types100.Interface{
+			Name: hostVethName,
+			Mac:  hostVeth.Attrs().HardwareAddr.String(),
+		})
+	}
 	result.Interfaces = append(result.Interfaces, &types100.Interface{
-		Name: hostVethName},
-	)
+		Name:    args.IfName,
+		Mac:     contVethMac,
+		Sandbox: args.Netns,
+	})
+	contIdx := len(result.Interfaces) - 1
+	// 1.1.0之前的结果里没有mtu字段
+	if versionAtLeast(ycniConf, cniVersion110) {
+		for _, iface := range result.Interfaces {
+			iface.Mtu = mtu
+		}
+	}
+	for _, ipc := range result.IPs {
+		// 路由模式下的网关是链路本地地址，不放到结果里
+		if !ycniConf.bridgeMode() {
+			ipc.Gateway = nil
+		}
+		ipc.Interface = types100.Int(contIdx)
+	}
+	result.Routes = routes
+	// kubelet自己生成resolv.conf，cnitool、podman和nerdctl等会使用结果里的dns
+	result.DNS = mergeDNS(&result.DNS, &ycniConf.DNS, ycniConf.RuntimeConfig.DNS)
 
-	for _, ip := range result.IPs {
-		ip.Gateway = nil
+	// 在conflist中不是第一个插件时，要在前面插件的结果上追加
+	if ycniConf.PrevResult != nil {
+		if result, err = mergePrevResult(ycniConf.PrevResult, result); err != nil {
+			log.Debugf("合并prevResult失败: %s", err.Error())
+			return decodingError(err, "合并prevResult失败", "failed to merge prevResult")
+		}
 	}
 
-	if err = result.Print(); err != nil {
+	if err = types.PrintResult(result, ycniConf.CNIVersion); err != nil {
 		log.Debugf("result Print error: %s", err.Error())
-		return err
+		return internalError(err, "输出结果失败", "failed to print result")
 	}
 
 	log.Debugf("cmdAdd success")
 	return nil
 }
+
+// mergePrevResult 把本插件的网卡、ip和路由追加到prevResult后面，ip的Interface下标要跟着偏移
+func mergePrevResult(prevResult types.Result, result *types100.Result) (*types100.Result, error) {
+	prev, err := types100.NewResultFromResult(prevResult)
+	if err != nil {
+		return nil, errors.Wrap(err, "转换prevResult失败")
+	}
+	offset := len(prev.Interfaces)
+	prev.Interfaces = append(prev.Interfaces, result.Interfaces...)
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil {
+			ipc.Interface = types100.Int(*ipc.Interface + offset)
+		}
+		prev.IPs = append(prev.IPs, ipc)
+	}
+	prev.Routes = append(prev.Routes, result.Routes...)
+	prev.DNS = mergeDNS(&prev.DNS, &result.DNS)
+	return prev, nil
+}
+
+// mergeDNS 按顺序合并，后面不为空的字段覆盖前面的
+func mergeDNS(dnsList ...*types.DNS) types.DNS {
+	merged := types.DNS{}
+	for _, dns := range dnsList {
+		if dns == nil {
+			continue
+		}
+		if len(dns.Nameservers) > 0 {
+			merged.Nameservers = dns.Nameservers
+		}
+		if dns.Domain != "" {
+			merged.Domain = dns.Domain
+		}
+		if len(dns.Search) > 0 {
+			merged.Search = dns.Search
+		}
+		if len(dns.Options) > 0 {
+			merged.Options = dns.Options
+		}
+	}
+	return merged
+}
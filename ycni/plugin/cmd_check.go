@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"net"
+	"strings"
+	"ycni/log"
+)
+
+func cmdCheck(args *skel.CmdArgs) error {
+	log.Debugf("cmdCheck containerID: %s", args.ContainerID)
+	log.Debugf("cmdCheck netNs: %s", args.Netns)
+	log.Debugf("cmdCheck ifName: %s", args.IfName)
+	log.Debugf("cmdCheck args: %s", args.Args)
+	log.Debugf("cmdCheck stdin: %s", string(args.StdinData))
+
+	// check时runtime会把add的结果放在prevResult中传进来
+	ycniConf, err := loadConf(args.StdinData)
+	if err != nil {
+		log.Debugf("加载cni配置文件错误: %s", err.Error())
+		return err
+	}
+	if err = requireVersion(ycniConf, cniVersion040, "CHECK"); err != nil {
+		return err
+	}
+	if ycniConf.PrevResult == nil {
+		return invalidConfigError(nil, "缺少prevResult", "missing prevResult")
+	}
+	result, err := types100.NewResultFromResult(ycniConf.PrevResult)
+	if err != nil {
+		log.Debugf("转换prevResult失败: %s", err.Error())
+		return decodingError(err, "转换prevResult失败", "failed to convert prevResult")
+	}
+
+	hostVethName, podIPs, err := ownResult(ycniConf, result, args)
+	if err != nil {
+		log.Debugf("读取hostVeth记录失败: %s", err.Error())
+		return ioError(err, "读取hostVeth记录失败", "failed to read host veth name")
+	}
+	log.Debugf("hostVethName: %s", hostVethName)
+
+	// 路由和add时一样按配置、注解和CNI_ARGS计算
+	cniargs := parseArgs(args.Args)
+	pod, err := getPod(ycniConf, cniargs)
+	if err != nil {
+		log.Debugf("获取pod信息失败: %s", err.Error())
+		return podLookupError(err)
+	}
+	routes, err := podRoutes(ycniConf, cniargs, pod)
+	if err != nil {
+		log.Debugf("解析路由失败: %s", err.Error())
+		return invalidConfigError(err, "解析路由失败", "invalid pod routes")
+	}
+	bw, err := podBandwidth(ycniConf, pod)
+	if err != nil {
+		log.Debugf("解析限速配置失败: %s", err.Error())
+		return invalidConfigError(err, "解析限速配置失败", "invalid bandwidth limits")
+	}
+
+	netNS, err := ns.GetNS(args.Netns)
+	if err != nil {
+		log.Debugf("打开ns失败: %s", err.Error())
+		return netnsError(err, "打开ns失败", "failed to open container network namespace")
+	}
+	defer netNS.Close()
+
+	// 检查容器内的veth、ip和路由
+	if err = netNS.Do(func(_ ns.NetNS) error {
+		return checkContainerVeth(ycniConf, args.IfName, podIPs, routes)
+	}); err != nil {
+		log.Debugf("检查容器网络失败: %s", err.Error())
+		return err
+	}
+
+	// 检查宿主机上的veth、arp代理和路由，ipvlan和macvlan时检查shim
+	if err = checkHostVeth(ycniConf, hostVethName, podIPs); err != nil {
+		log.Debugf("检查宿主机网络失败: %s", err.Error())
+		return err
+	}
+
+	// 检查限速队列
+	if err = checkBandwidth(hostVethName, bw); err != nil {
+		log.Debugf("检查限速失败: %s", err.Error())
+		return err
+	}
+
+	log.Debugf("cmdCheck success")
+	return nil
+}
+
+// ownResult 在prevResult中找出本插件添加的hostVeth和容器ip，conflist中前面插件的结果不检查
+func ownResult(ycniConf *YCNIConfig, result *types100.Result, args *skel.CmdArgs) (string, []*types100.IPConfig, error) {
+	contIdx := -1
+	for i, iface := range result.Interfaces {
+		if iface.Name == args.IfName && iface.Sandbox == args.Netns {
+			contIdx = i
+			break
+		}
+	}
+
+	// add时hostVeth紧挨在容器网卡前面
+	hostVethName := ""
+	if contIdx > 0 && result.Interfaces[contIdx-1].Sandbox == "" {
+		hostVethName = result.Interfaces[contIdx-1].Name
+	}
+	if hostVethName == "" {
+		var err error
+		if hostVethName, err = lookupHostVethName(ycniConf, args); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var podIPs []*types100.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Interface == nil || contIdx < 0 || *ipc.Interface == contIdx {
+			podIPs = append(podIPs, ipc)
+		}
+	}
+	return hostVethName, podIPs, nil
+}
+
+// checkContainerVeth 需要在容器ns中调用
+func checkContainerVeth(ycniConf *YCNIConfig, ifName string, ips []*types100.IPConfig, routes []*types.Route) error {
+	nsVeth, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return linkError(err, fmt.Sprintf("没找到ns内的veth: %s", ifName), "container interface not found")
+	}
+	if nsVeth.Type() != ycniConf.interfaceType() {
+		return driftError(cniDetail(nsVeth.Type()), fmt.Sprintf("ns内的%s不是%s", ifName, ycniConf.interfaceType()), "container interface has the wrong type")
+	}
+
+	addrs, err := netlink.AddrList(nsVeth, netlink.FAMILY_ALL)
+	if err != nil {
+		return internalError(err, "获取容器内veth地址失败", "failed to list container interface addresses")
+	}
+	var hasIpv4, hasIpv6 bool
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() != nil {
+			hasIpv4 = true
+		} else {
+			hasIpv6 = true
+		}
+		if !hasAddr(addrs, &ipc.Address) {
+			return driftError(cniDetail(ipc.Address.String()), "容器内veth缺少ip", "container interface is missing an IP address")
+		}
+	}
+	// 网桥模式下网关在子网内，没有单独的网关路由
+	gws := routedGateways(hasIpv4, hasIpv6)
+	gwIPNet, gwIPNet6 := defaultGwIPNet, defaultGwIPNet6
+	if ycniConf.bridgeMode() {
+		if gws, _, err = bridgeGateways(ips); err != nil {
+			return invalidConfigError(err, "prevResult中缺少网关", "prevResult has no gateway for bridge mode")
+		}
+		gwIPNet, gwIPNet6 = nil, nil
+	}
+	routes = familyRoutes(routes, gws)
+	if hasIpv4 {
+		// 169.254.1.1 dev eth0 scope link, 默认还有0.0.0.0/0 via 169.254.1.1 dev eth0
+		if err = checkContainerRoutes(nsVeth, netlink.FAMILY_V4, gwIPNet, gws, routes); err != nil {
+			return err
+		}
+	}
+	if hasIpv6 {
+		// fe80::1 dev eth0 scope link, 默认还有::/0 via fe80::1 dev eth0
+		if err = checkContainerRoutes(nsVeth, netlink.FAMILY_V6, gwIPNet6, gws, routes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkContainerRoutes gwIPNet为nil时不检查网关路由
+func checkContainerRoutes(nsVeth netlink.Link, family int, gwIPNet *net.IPNet, gws podGateways, routes []*types.Route) error {
+	linkRoutes, err := netlink.RouteList(nsVeth, family)
+	if err != nil {
+		return internalError(err, "获取容器内路由失败", "failed to list container routes")
+	}
+	if gwIPNet != nil && !hasRoute(linkRoutes, func(r netlink.Route) bool {
+		return r.Scope == netlink.SCOPE_LINK && r.Dst != nil && r.Dst.String() == gwIPNet.String()
+	}) {
+		return driftError(cniDetail(gwIPNet.String()), "容器内缺少网关路由", "container is missing the gateway route")
+	}
+	// 不走pod网关的路由可能在其他网卡上
+	allRoutes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return internalError(err, "获取容器内路由失败", "failed to list container routes")
+	}
+	for _, r := range routes {
+		if (r.Dst.IP.To4() != nil) != (family == netlink.FAMILY_V4) {
+			continue
+		}
+		dst := r.Dst.String()
+		if !hasRoute(allRoutes, func(route netlink.Route) bool {
+			// 默认路由在内核里的Dst是nil
+			routeDst := IPv4AllNet.String()
+			if family == netlink.FAMILY_V6 {
+				routeDst = IPv6AllNet.String()
+			}
+			if route.Dst != nil {
+				routeDst = route.Dst.String()
+			}
+			return routeDst == dst && route.Gw.Equal(r.GW) && (!gws.contains(r.GW) || route.LinkIndex == nsVeth.Attrs().Index)
+		}) {
+			return driftError(cniDetail(dst), "容器内缺少路由", "container is missing a route")
+		}
+	}
+	return nil
+}
+
+func checkHostVeth(ycniConf *YCNIConfig, hostVethName string, ips []*types100.IPConfig) error {
+	// ipvlan和macvlan没有hostVeth，检查shim和shim上到pod的路由
+	if ycniConf.shimMode() {
+		podIPs := make([]net.IPNet, 0, len(ips))
+		for _, ipc := range ips {
+			podIPs = append(podIPs, ipc.Address)
+		}
+		return checkShim(ycniConf, podIPs)
+	}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return linkError(err, fmt.Sprintf("没有找到hostVeth: %s", hostVethName), "host veth not found")
+	}
+	if hostVeth.Attrs().Flags&net.FlagUp == 0 {
+		return driftError(cniDetail(hostVethName), "hostVeth未up", "host veth is down")
+	}
+	// 网桥模式下没有arp代理和到pod的路由
+	if ycniConf.bridgeMode() {
+		return checkBridgePort(hostVeth, ycniConf.bridgeName())
+	}
+
+	var hasIpv4, hasIpv6 bool
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() != nil {
+			hasIpv4 = true
+		} else {
+			hasIpv6 = true
+		}
+	}
+	if hasIpv4 {
+		proxyArp, err := readProcSys(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", hostVethName))
+		if err != nil {
+			return internalError(err, "读取arp代理配置失败", "failed to read proxy_arp")
+		}
+		if strings.TrimSpace(proxyArp) != "1" {
+			return driftError(cniDetail(hostVethName), "hostVeth未开启arp代理", "proxy_arp is not enabled on host veth")
+		}
+	}
+	if hasIpv6 {
+		proxyNdp, err := readProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/proxy_ndp", hostVethName))
+		if err != nil {
+			return internalError(err, "读取ndp代理配置失败", "failed to read proxy_ndp")
+		}
+		if strings.TrimSpace(proxyNdp) != "1" {
+			return driftError(cniDetail(hostVethName), "hostVeth未开启ndp代理", "proxy_ndp is not enabled on host veth")
+		}
+	}
+
+	routes, err := netlink.RouteList(hostVeth, netlink.FAMILY_ALL)
+	if err != nil {
+		return internalError(err, "获取宿主机路由失败", "failed to list host routes")
+	}
+	for _, ipc := range ips {
+		dst := ipc.Address.String()
+		if !hasRoute(routes, func(r netlink.Route) bool {
+			return r.Dst != nil && r.Dst.String() == dst
+		}) {
+			return driftError(cniDetail(dst), "宿主机缺少到容器的路由", "host is missing the route to the pod")
+		}
+	}
+	return nil
+}
+
+func hasAddr(addrs []netlink.Addr, ipNet *net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr.IPNet != nil && addr.IPNet.String() == ipNet.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRoute(routes []netlink.Route, match func(r netlink.Route) bool) bool {
+	for _, r := range routes {
+		if match(r) {
+			return true
+		}
+	}
+	return false
+}
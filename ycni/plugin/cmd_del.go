@@ -1,17 +1,18 @@
 package main
 
 import (
-	"encoding/json"
 	"github.com/containernetworking/cni/pkg/skel"
-	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
-	"github.com/containernetworking/plugins/pkg/ipam"
-	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
-	"github.com/pkg/errors"
+	"github.com/containernetworking/plugins/pkg/ns"
 	"net"
+	"os"
 	"ycni/log"
 )
 
+// cmdDel 按规范DEL要能重复调用，资源已经不存在时不报错。
+// 某一步失败后继续清理后面的资源，最后返回第一个错误，runtime重试时只需要处理剩下的
 func cmdDel(args *skel.CmdArgs) error {
 	log.Debugf("cmdDel containerID: %s", args.ContainerID)
 	log.Debugf("cmdDel netNs: %s", args.Netns)
@@ -20,78 +21,194 @@ func cmdDel(args *skel.CmdArgs) error {
 	log.Debugf("cmdDel path: %s", args.Path)
 	log.Debugf("cmdDel stdin: %s", string(args.StdinData))
 
-	var err error
-	var ycniConf YCNIConfig
-	err = json.Unmarshal(args.StdinData, &ycniConf)
+	// 配置解析失败时按hostVeth记录清理，del用不到prevResult，解析失败时不影响清理
+	ycniConf, err := parseConf(args.StdinData)
 	if err != nil {
-		log.Debugf("加载cni配置文件错误: %s", err.Error())
-		return errors.Wrap(err, "加载cni配置文件错误")
+		log.Debugf("加载cni配置文件错误, 按hostVeth记录清理: %s", err.Error())
+		return minimalTeardown(args)
+	}
+	if err = version.ParsePrevResult(&ycniConf.NetConf); err != nil {
+		log.Debugf("解析prevResult失败，忽略: %s", err.Error())
+		ycniConf.PrevResult = nil
 	}
 
 	log.Debugf("cmdDel conf: %+v", ycniConf)
 
-	// 释放ip
-	ipNet, err := types.ParseCIDR(ycniConf.IPAM.Subnet)
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	hostVethName, err := lookupHostVethName(ycniConf, args)
 	if err != nil {
-		return errors.Wrap(err, "parse子网失败")
+		log.Debugf("读取hostVeth记录失败: %s", err.Error())
+		return ioError(err, "读取hostVeth记录失败", "failed to read host veth name")
 	}
-	var startIP, endIP net.IP
-	if ycniConf.IPAM.RangeStart != "" {
-		startIP = net.ParseIP(ycniConf.IPAM.RangeStart)
-		if startIP == nil {
-			return errors.Wrap(err, "解析start ip 失败")
+	log.Debugf("hostVethName: %s", hostVethName)
+
+	// veth删掉后路由也没了，先从宿主机路由里找出pod的ip，veth已经不在时用prevResult里的ip，
+	// 都没有时用ip分配记录，ipvlan和macvlan没有hostVeth，一般走到这里
+	podIPs, err := hostVethPodIPs(hostVethName)
+	if err != nil {
+		log.Debugf("获取pod ip失败: %s", err.Error())
+	}
+	if len(podIPs) == 0 {
+		podIPs = prevResultPodIPs(ycniConf)
+	}
+	if len(podIPs) == 0 {
+		if podIPs, err = allocatedPodIPs(ycniConf, args.ContainerID, args.IfName); err != nil {
+			log.Debugf("读取ip分配记录失败: %s", err.Error())
 		}
 	}
-	if ycniConf.IPAM.RangeEnd != "" {
-		endIP = net.ParseIP(ycniConf.IPAM.RangeEnd)
-		if endIP == nil {
-			return errors.Wrap(err, "解析end ip失败")
+
+	// 删除veth pair，宿主机这一端不存在时尝试删除容器内的网卡
+	if err = delVethPair(hostVethName, args); err != nil {
+		log.Debugf("删除veth失败: %s", err.Error())
+		fail(internalError(err, "删除veth失败", "failed to delete host veth"))
+	}
+	// shim是所有pod共用的，只删除到这个pod的路由
+	if ycniConf.shimMode() {
+		if err = delShimRoutes(ycniConf, podIPs); err != nil {
+			log.Debugf("删除shim路由失败: %s", err.Error())
+			fail(internalError(err, "删除shim路由失败", "failed to delete shim routes"))
 		}
 	}
+	// hostVeth上的限速队列随veth删除，ifb要单独删
+	if err = teardownBandwidth(hostVethName); err != nil {
+		log.Debugf("删除限速失败: %s", err.Error())
+		fail(internalError(err, "删除限速失败", "failed to delete ifb device"))
+	}
 
-	ipamConf := allocator.Net{
-		Name:       ycniConf.Name,
-		CNIVersion: ycniConf.CNIVersion,
-		IPAM: &allocator.IPAMConfig{
-			Type: ycniConf.IPAM.Type,
-			Ranges: []allocator.RangeSet{
-				{
-					{
-						Subnet:     types.IPNet(*ipNet),
-						RangeStart: startIP,
-						RangeEnd:   endIP,
-					},
-				},
-			},
-		},
-	}
-	ipamConfBytes, err := json.Marshal(ipamConf)
+	// 删除转发规则，子网的masquerade规则其他pod还在用，不删除
+	dp, err := newTeardownDatapath(ycniConf)
 	if err != nil {
-		return errors.Wrapf(err, "marshal ipam conf error")
+		log.Debugf("初始化datapath失败: %s", err.Error())
+		fail(invalidConfigError(err, "初始化datapath失败", "failed to initialize datapath"))
+	} else {
+		if err = dp.teardownPod(hostVethName, podIPs); err != nil {
+			log.Debugf("删除转发规则失败: %s", err.Error())
+			fail(internalError(err, "删除转发规则失败", "failed to delete forwarding rules"))
+		}
+		// del时不一定带portMappings，按hostVeth删除
+		if err = dp.teardownPortMappings(hostVethName); err != nil {
+			log.Debugf("删除端口映射失败: %s", err.Error())
+			fail(internalError(err, "删除端口映射失败", "failed to delete port mappings"))
+		}
+	}
+
+	// 网络清理完再释放ip，避免ip被新pod拿到时旧规则还在；没有分配记录时不报错
+	if err = ipamDel(ycniConf, args); err != nil {
+		log.Debugf("释放ip失败: %s", err.Error())
+		fail(err)
+	}
+
+	// 前面失败时保留记录，重试的DEL还能找到同一个veth
+	if firstErr != nil {
+		return firstErr
+	}
+	if err = removeHostVethName(ycniConf, args); err != nil {
+		log.Debugf("删除hostVeth记录失败: %s", err.Error())
+		return ioError(err, "删除hostVeth记录失败", "failed to remove host veth name")
 	}
-	log.Debugf("ipamConfBytes: %s", string(ipamConfBytes))
 
-	err = ipam.ExecDel(ycniConf.IPAM.Type, ipamConfBytes)
+	log.Debugf("cmdDel: success")
+	return nil
+}
+
+// minimalTeardown 节点重启后配置文件可能还没生成或者已经损坏，拿不到配置时只按hostVeth记录删除veth、ifb
+// 和hostVeth的规则，ip留给GC回收。只有清理本身失败时才返回错误，否则runtime会一直重试
+func minimalTeardown(args *skel.CmdArgs) error {
+	record, hostVethName, err := findHostVethRecord(args.ContainerID, args.IfName)
 	if err != nil {
-		log.Debugf("释放ip失败")
-		return errors.Wrap(err, "释放ip失败")
+		log.Debugf("读取hostVeth记录失败: %s", err.Error())
+		return ioError(err, "读取hostVeth记录失败", "failed to read host veth name")
+	}
+	if hostVethName == "" {
+		hostVethName = hostVethNameFor(args, parseArgs(args.Args))
 	}
-	
-	cniargs := parseArgs(args.Args)
-	hostVethName := vethNameForWorkload(cniargs.namespace, cniargs.podName)
 	log.Debugf("hostVethName: %s", hostVethName)
-	// 删除veth pair
-	if err = ip.DelLinkByName(hostVethName); err != nil {
-		log.Debugf("删除veth失败")
-		return errors.Wrap(err, "删除veth失败")
+
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	// nftables集合里的pod ip要在veth删除前从路由里找出来
+	podIPs, err := hostVethPodIPs(hostVethName)
+	if err != nil {
+		log.Debugf("获取pod ip失败: %s", err.Error())
+	}
+	if err = delVethPair(hostVethName, args); err != nil {
+		log.Debugf("删除veth失败: %s", err.Error())
+		fail(internalError(err, "删除veth失败", "failed to delete host veth"))
 	}
+	if err = teardownBandwidth(hostVethName); err != nil {
+		log.Debugf("删除限速失败: %s", err.Error())
+		fail(internalError(err, "删除限速失败", "failed to delete ifb device"))
+	}
+	for _, dp := range newFallbackDatapaths() {
+		if err = dp.teardownPod(hostVethName, podIPs); err != nil {
+			log.Debugf("删除转发规则失败: %s", err.Error())
+			fail(internalError(err, "删除转发规则失败", "failed to delete forwarding rules"))
+		}
+		if err = dp.teardownPortMappings(hostVethName); err != nil {
+			log.Debugf("删除端口映射失败: %s", err.Error())
+			fail(internalError(err, "删除端口映射失败", "failed to delete port mappings"))
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if record != "" {
+		if err = os.Remove(record); err != nil && !os.IsNotExist(err) {
+			log.Debugf("删除hostVeth记录失败: %s", err.Error())
+			return ioError(err, "删除hostVeth记录失败", "failed to remove host veth name")
+		}
+	}
+	log.Debugf("cmdDel: 按hostVeth记录清理完成")
+	return nil
+}
 
-	// 删除forward链
-	Exec("iptables", "-D", "FORWARD", "--out-interface", defaultOutInterface, "--in-interface", hostVethName)
-	Exec("iptables", "-D", "FORWARD", "--out-interface", hostVethName, "--in-interface", defaultOutInterface)
-	// 设置postrouting链
-	Exec("iptables", "-t", "nat", "-D", "POSTROUTING", "--source", ycniConf.IPAM.Subnet, "--out-interface", defaultOutInterface)
+// delVethPair 删除任意一端都会把两端一起删掉，两端都不存在或者ns已经不在时不报错
+func delVethPair(hostVethName string, args *skel.CmdArgs) error {
+	err := ip.DelLinkByName(hostVethName)
+	if err == nil {
+		return nil
+	}
+	if err != ip.ErrLinkNotFound {
+		return err
+	}
+	if args.Netns == "" {
+		return nil
+	}
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil && err != ip.ErrLinkNotFound {
+			return err
+		}
+		return nil
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+	return err
+}
 
-	log.Debugf("cmdDel: success")
-	return nil
+// prevResultPodIPs 从prevResult中取出pod的ip，没有prevResult时返回空
+func prevResultPodIPs(ycniConf *YCNIConfig) []net.IPNet {
+	if ycniConf.PrevResult == nil {
+		return nil
+	}
+	result, err := types100.NewResultFromResult(ycniConf.PrevResult)
+	if err != nil {
+		log.Debugf("转换prevResult失败: %s", err.Error())
+		return nil
+	}
+	var podIPs []net.IPNet
+	for _, ipc := range result.IPs {
+		podIPs = append(podIPs, ipc.Address)
+	}
+	return podIPs
 }
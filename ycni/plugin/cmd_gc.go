@@ -0,0 +1,224 @@
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/vishvananda/netlink"
+	"net"
+	"regexp"
+	"ycni/log"
+)
+
+var (
+	// ycni创建的hostVeth和ifb的名字，见vethName和ifbNameForVeth
+	ycniVethNameRe = regexp.MustCompile(`^veth[0-9a-f]{11}$`)
+	ycniIFBNameRe  = regexp.MustCompile(`^ifb[0-9a-f]{11}$`)
+)
+
+// cmdGC runtime在cni.dev/valid-attachments中传入还在用的容器网卡，
+// 其他的hostVeth、限速、转发规则、端口映射和ip分配都是ADD中途失败或者DEL没执行时泄漏的，全部清理掉。
+// 和DEL一样某一步失败后继续清理，最后返回第一个错误
+func cmdGC(args *skel.CmdArgs) error {
+	log.Debugf("cmdGC stdin: %s", string(args.StdinData))
+
+	ycniConf, err := parseConf(args.StdinData)
+	if err != nil {
+		log.Debugf("加载cni配置文件错误: %s", err.Error())
+		return err
+	}
+	if err = requireVersion(ycniConf, cniVersion110, "GC"); err != nil {
+		return err
+	}
+
+	valid := map[string]bool{}
+	for _, a := range ycniConf.ValidAttachments {
+		valid[attachmentKey(a.ContainerID, a.IfName)] = true
+	}
+
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	ipamConf, err := buildIPAMConf(ycniConf)
+	if err != nil {
+		log.Debugf("获取ipam配置失败: %s", err.Error())
+		return invalidConfigError(err, "获取ipam配置失败", "invalid ipam configuration")
+	}
+	// 内置ipam和host-local的存储格式一样，直接清理存储目录，其他类型的ipam不处理
+	var allocations map[string]*ipamAllocation
+	if ycniConf.IPAM.Type == ycniIPAMType || ycniConf.IPAM.Type == "host-local" {
+		if allocations, err = listAllocations(ipamConf); err != nil {
+			log.Debugf("读取ip分配记录失败: %s", err.Error())
+			fail(ioError(err, "读取ip分配记录失败", "failed to list IP allocations"))
+		}
+	} else {
+		log.Debugf("ipam类型%s不支持gc，跳过ip回收", ycniConf.IPAM.Type)
+	}
+
+	// 先清理网络，再释放ip，避免ip被新pod拿到时旧规则还在
+	if err = gcHostVeths(ycniConf, valid, allocations); err != nil {
+		fail(err)
+	}
+
+	for key, a := range allocations {
+		if valid[key] {
+			continue
+		}
+		log.Debugf("回收ip: %s %s %v", a.containerID, a.ifName, a.ips)
+		if err = releaseAllocation(ipamConf, a); err != nil {
+			log.Debugf("回收ip失败: %s", err.Error())
+			fail(ioError(err, "回收ip失败", "failed to release leaked IP address"))
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+	log.Debugf("cmdGC: success")
+	return nil
+}
+
+// gcHostVeths 按ADD时的hostVeth记录找出不在valid中的veth，删除veth和相关的规则。
+// 没有记录的veth也要回收：ADD在保存记录前失败、老版本插件创建的或者记录丢了
+func gcHostVeths(ycniConf *YCNIConfig, valid map[string]bool, allocations map[string]*ipamAllocation) error {
+	records, err := listHostVethNames(ycniConf)
+	if err != nil {
+		log.Debugf("读取hostVeth记录失败: %s", err.Error())
+		return ioError(err, "读取hostVeth记录失败", "failed to list host veth names")
+	}
+	// 记录损坏时也不能删掉还在用的veth，没有记录的按当前命名规则算出来
+	inUse := map[string]bool{}
+	for key, name := range records {
+		if valid[key] {
+			inUse[name] = true
+		}
+	}
+	for _, a := range ycniConf.ValidAttachments {
+		inUse[vethNameForAttachment(a.ContainerID, a.IfName)] = true
+	}
+
+	dp, err := newTeardownDatapath(ycniConf)
+	if err != nil {
+		log.Debugf("初始化datapath失败: %s", err.Error())
+		return invalidConfigError(err, "初始化datapath失败", "failed to initialize datapath")
+	}
+
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for key, hostVethName := range records {
+		if valid[key] {
+			continue
+		}
+		if err = gcHostVeth(ycniConf, dp, hostVethName, inUse[hostVethName], allocations[key]); err != nil {
+			fail(err)
+			continue
+		}
+		if err = removeHostVethRecord(ycniConf, key); err != nil {
+			log.Debugf("删除hostVeth记录失败: %s", err.Error())
+			fail(ioError(err, "删除hostVeth记录失败", "failed to remove host veth name"))
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Debugf("获取宿主机网卡失败: %s", err.Error())
+		fail(internalError(err, "获取宿主机网卡失败", "failed to list host links"))
+		return firstErr
+	}
+	veths, ifbs := orphanedHostLinks(links, inUse)
+	for _, hostVethName := range veths {
+		if err = gcHostVeth(ycniConf, dp, hostVethName, false, nil); err != nil {
+			fail(err)
+		}
+	}
+	for _, ifbName := range ifbs {
+		log.Debugf("回收ifb: %s", ifbName)
+		if err = ip.DelLinkByName(ifbName); err != nil && err != ip.ErrLinkNotFound {
+			log.Debugf("删除ifb失败: %s", err.Error())
+			fail(internalError(err, "删除ifb失败", "failed to delete leaked ifb device"))
+		}
+	}
+	return firstErr
+}
+
+// orphanedHostLinks 找出没有记录的泄漏设备：名字符合ycni的命名规则、不在inUse中、另一端已经不在用的veth，
+// 以及对应的veth已经不存在的ifb。不知道veth属于哪个网络，另一端还在用的veth可能是其他网络的，不处理
+func orphanedHostLinks(links []netlink.Link, inUse map[string]bool) ([]string, []string) {
+	var veths []string
+	// 要回收的veth的ifb由gcHostVeth一起删除
+	handled := map[string]bool{}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "veth" || !ycniVethNameRe.MatchString(name) {
+			continue
+		}
+		handled[ifbNameForVeth(name)] = true
+		if inUse[name] || vethPeerAlive(link) {
+			continue
+		}
+		veths = append(veths, name)
+	}
+	var ifbs []string
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() == "ifb" && ycniIFBNameRe.MatchString(name) && !handled[name] {
+			ifbs = append(ifbs, name)
+		}
+	}
+	return veths, ifbs
+}
+
+// vethPeerAlive ADD会把两端都设置成up，hostVeth没有up或者另一端down了说明ADD中途失败或者容器网卡已经不用了。
+// 另一端所在的netns删除时内核会把两端一起删掉
+func vethPeerAlive(link netlink.Link) bool {
+	attrs := link.Attrs()
+	return attrs.Flags&net.FlagUp != 0 && attrs.OperState != netlink.OperLowerLayerDown
+}
+
+// gcHostVeth 删除一个泄漏的hostVeth和它的限速、转发规则及端口映射，宿主机上到pod的/32和/128路由随veth一起删除，
+// veth已经不在时用ip分配记录里的ip删除规则。
+// ipvlan和macvlan没有hostVeth，要删除的是shim上到pod的路由
+func gcHostVeth(ycniConf *YCNIConfig, dp datapath, hostVethName string, inUse bool, allocation *ipamAllocation) error {
+	if hostVethName == "" || inUse {
+		return nil
+	}
+	log.Debugf("回收hostVeth: %s", hostVethName)
+	podIPs, err := hostVethPodIPs(hostVethName)
+	if err != nil {
+		log.Debugf("获取pod ip失败: %s", err.Error())
+	}
+	if len(podIPs) == 0 && allocation != nil {
+		podIPs = allocation.ipNets()
+	}
+
+	if err = ip.DelLinkByName(hostVethName); err != nil && err != ip.ErrLinkNotFound {
+		log.Debugf("删除veth失败: %s", err.Error())
+		return internalError(err, "删除veth失败", "failed to delete leaked host veth")
+	}
+	if err = teardownBandwidth(hostVethName); err != nil {
+		log.Debugf("删除限速失败: %s", err.Error())
+		return internalError(err, "删除限速失败", "failed to delete leaked ifb device")
+	}
+	if err = dp.teardownPod(hostVethName, podIPs); err != nil {
+		log.Debugf("删除转发规则失败: %s", err.Error())
+		return internalError(err, "删除转发规则失败", "failed to delete leaked forwarding rules")
+	}
+	if err = dp.teardownPortMappings(hostVethName); err != nil {
+		log.Debugf("删除端口映射失败: %s", err.Error())
+		return internalError(err, "删除端口映射失败", "failed to delete leaked port mappings")
+	}
+	if ycniConf.shimMode() {
+		if err = delShimRoutes(ycniConf, podIPs); err != nil {
+			log.Debugf("删除shim路由失败: %s", err.Error())
+			return internalError(err, "删除shim路由失败", "failed to delete leaked shim routes")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestOrphanedHostLinks(t *testing.T) {
+	live := vethNameForAttachment("live", "eth0")
+	valid := vethNameForAttachment("valid", "eth0")
+	failedAdd := vethNameForAttachment("failed", "eth0")
+	peerDown := vethNameForAttachment("peerdown", "eth0")
+	veth := func(name string, up bool, state netlink.LinkOperState) netlink.Link {
+		attrs := netlink.LinkAttrs{Name: name, OperState: state}
+		if up {
+			attrs.Flags = net.FlagUp
+		}
+		return &netlink.Veth{LinkAttrs: attrs}
+	}
+	ifb := func(name string) netlink.Link {
+		return &netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	}
+	links := []netlink.Link{
+		veth(live, true, netlink.OperUp),
+		veth(valid, false, netlink.OperDown),
+		veth(failedAdd, false, netlink.OperDown),
+		veth(peerDown, true, netlink.OperLowerLayerDown),
+		// 不是ycni的命名规则
+		veth("vethabc", false, netlink.OperDown),
+		veth("cali1234567890a", false, netlink.OperDown),
+		&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: vethNameForAttachment("dummy", "eth0")}},
+		ifb(ifbNameForVeth(live)),
+		ifb(ifbNameForVeth(failedAdd)),
+		ifb(ifbNameForVeth("vethdeadbeef000")),
+		ifb("ifb0"),
+	}
+	veths, ifbs := orphanedHostLinks(links, map[string]bool{valid: true})
+	sort.Strings(veths)
+	want := []string{failedAdd, peerDown}
+	sort.Strings(want)
+	if !reflect.DeepEqual(veths, want) {
+		t.Errorf("orphanedHostLinks() veths = %v, want %v", veths, want)
+	}
+	if !reflect.DeepEqual(ifbs, []string{ifbNameForVeth("vethdeadbeef000")}) {
+		t.Errorf("orphanedHostLinks() ifbs = %v, want %v", ifbs, []string{ifbNameForVeth("vethdeadbeef000")})
+	}
+}
+
+// 在单独的netns里验证没有记录的veth和ifb会被回收，还在用的不动，需要root
+func TestGCHostVethsUnrecorded(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("需要root")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatalf("netns.Get(): %v", err)
+	}
+	defer origin.Close()
+	testNS, err := netns.New()
+	if err != nil {
+		t.Skipf("创建netns失败: %v", err)
+	}
+	defer func() {
+		_ = netns.Set(origin)
+		testNS.Close()
+	}()
+
+	conf := &YCNIConfig{Datapath: datapathNFTables, IPAM: IPAM{Type: ycniIPAMType, Subnet: "10.0.0.0/28"}}
+	conf.Name = "ycni-gc-test-unrecorded"
+	conf.ValidAttachments = []types.GCAttachment{{ContainerID: "valid", IfName: "eth0"}}
+
+	addVeth := func(name string, peerUp bool) {
+		t.Helper()
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: "p" + name[4:]}
+		if err := netlink.LinkAdd(veth); err != nil {
+			t.Fatalf("创建veth %s: %v", name, err)
+		}
+		if err := netlink.LinkSetUp(veth); err != nil {
+			t.Fatalf("veth up %s: %v", name, err)
+		}
+		if peerUp {
+			peer, err := netlink.LinkByName(veth.PeerName)
+			if err != nil {
+				t.Fatalf("没找到peer %s: %v", veth.PeerName, err)
+			}
+			if err = netlink.LinkSetUp(peer); err != nil {
+				t.Fatalf("peer up %s: %v", veth.PeerName, err)
+			}
+		}
+	}
+	leaked := vethNameForAttachment("leaked", "eth0")
+	valid := vethNameForAttachment("valid", "eth0")
+	other := vethNameForAttachment("other-network", "eth0")
+	addVeth(leaked, false)
+	addVeth(valid, false)
+	addVeth(other, true)
+	orphanIFB := ifbNameForVeth("vethdeadbeef000")
+	if err = netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: orphanIFB}}); err != nil {
+		t.Skipf("创建ifb失败: %v", err)
+	}
+
+	if err = gcHostVeths(conf, map[string]bool{attachmentKey("valid", "eth0"): true}, nil); err != nil {
+		t.Fatalf("gcHostVeths() error = %v", err)
+	}
+	for name, want := range map[string]bool{leaked: false, orphanIFB: false, valid: true, other: true} {
+		_, err := netlink.LinkByName(name)
+		if exists := err == nil; exists != want {
+			t.Errorf("gcHostVeths()之后%s存在 = %v, want %v", name, exists, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"time"
+	"ycni/log"
+)
+
+// ycnid每10秒更新一次就绪文件，留出几次更新失败的余量
+const readyFileMaxAge = time.Minute
+
+// cmdStatus runtime用来判断节点能不能创建pod，未就绪时kubelet会暂停创建pod，
+// 而不是创建出网络不通的pod。返回nil表示就绪
+func cmdStatus(args *skel.CmdArgs) error {
+	log.Debugf("cmdStatus stdin: %s", string(args.StdinData))
+
+	ycniConf, err := parseConf(args.StdinData)
+	if err != nil {
+		log.Debugf("加载cni配置文件错误: %s", err.Error())
+		return err
+	}
+	if err = requireVersion(ycniConf, cniVersion110, "STATUS"); err != nil {
+		return err
+	}
+
+	// ycnid还没初始化完或者已经退出，跨节点的路由和vtep没人维护。
+	// ycnid运行时定期更新就绪文件，异常退出时文件会留下来，修改时间太旧也按未就绪处理
+	if ycniConf.ReadyFile != "" {
+		info, err := os.Stat(ycniConf.ReadyFile)
+		if err != nil {
+			log.Debugf("ycnid未就绪: %s", err.Error())
+			return newCNIError(errCodePluginNotAvailable, err, "ycnid未就绪", "ycnid is not ready")
+		}
+		if age := time.Since(info.ModTime()); age > readyFileMaxAge {
+			log.Debugf("就绪文件%s未更新: %s", ycniConf.ReadyFile, age)
+			return newCNIError(errCodePluginNotAvailable, errors.Errorf("就绪文件%s已经%s没有更新", ycniConf.ReadyFile, age.Round(time.Second)), "ycnid未就绪", "ycnid heartbeat is stale")
+		}
+	}
+
+	// overlay设备不在或者down了，已有的pod跨节点也不通
+	if ycniConf.OverlayDevice != "" {
+		link, err := netlink.LinkByName(ycniConf.OverlayDevice)
+		if err != nil {
+			log.Debugf("没有找到overlay设备: %s", err.Error())
+			return newCNIError(errCodeLimitedConnectivity, err, fmt.Sprintf("没有找到overlay设备: %s", ycniConf.OverlayDevice), "overlay device not found")
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			log.Debugf("overlay设备未up: %s", ycniConf.OverlayDevice)
+			return newCNIError(errCodeLimitedConnectivity, cniDetail(ycniConf.OverlayDevice), "overlay设备未up", "overlay device is down")
+		}
+	}
+
+	// 内置ipam和host-local的存储格式一样，其他类型的ipam不检查
+	if ycniConf.IPAM.Type != ycniIPAMType && ycniConf.IPAM.Type != "host-local" {
+		log.Debugf("cmdStatus: ready")
+		return nil
+	}
+	ipamConf, err := buildIPAMConf(ycniConf)
+	if err != nil {
+		log.Debugf("获取ipam配置失败: %s", err.Error())
+		return invalidConfigError(err, "获取ipam配置失败", "invalid ipam configuration")
+	}
+	if err = checkStoreWritable(ipamConf); err != nil {
+		log.Debugf("ipam存储不可写: %s", err.Error())
+		return newCNIError(errCodePluginNotAvailable, err, "ipam存储不可写", "ipam store is not writable")
+	}
+	allocations, err := listAllocations(ipamConf)
+	if err != nil {
+		log.Debugf("读取ip分配记录失败: %s", err.Error())
+		return newCNIError(errCodePluginNotAvailable, err, "读取ip分配记录失败", "failed to list IP allocations")
+	}
+	rangeSet, err := exhaustedRangeSet(ipamConf, allocations)
+	if err != nil {
+		log.Debugf("检查ip余量失败: %s", err.Error())
+		return invalidConfigError(err, "检查ip余量失败", "invalid ipam configuration")
+	}
+	if rangeSet != nil {
+		log.Debugf("没有可分配的ip: %s", rangeSet.String())
+		return newCNIError(errCodePluginNotAvailable, cniDetail(rangeSet.String()), "没有可分配的ip", "no IP addresses available in the node's ranges")
+	}
+
+	log.Debugf("cmdStatus: ready")
+	return nil
+}
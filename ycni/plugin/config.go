@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// IPRange 一段可分配的地址，不配置起止ip时使用整个子网
+type IPRange struct {
+	Subnet     string `json:"subnet"`
+	RangeStart string `json:"rangeStart,omitempty"`
+	RangeEnd   string `json:"rangeEnd,omitempty"`
+}
+
+type IPAM struct {
+	Type       string `json:"type"`
+	Subnet     string `json:"subnet"`
+	RangeStart string `json:"rangeStart"`
+	RangeEnd   string `json:"rangeEnd"`
+	// 双栈时的ipv6子网
+	Subnet6     string `json:"subnet6,omitempty"`
+	RangeStart6 string `json:"rangeStart6,omitempty"`
+	RangeEnd6   string `json:"rangeEnd6,omitempty"`
+	// 分配记录的存放目录，和host-local一样默认是/var/lib/cni/networks
+	DataDir string `json:"dataDir,omitempty"`
+	// 多个range set，每个range set分配一个ip，同一个range set里的range必须是同一个地址族。
+	// 配置了ranges时忽略subnet和subnet6
+	Ranges [][]IPRange `json:"ranges,omitempty"`
+	// 不参与分配的ip或网段，例如给节点本地服务预留的地址
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// RuntimeConfig runtime按capabilities注入的参数
+type RuntimeConfig struct {
+	// ips capability，pod指定的ip，可以带掩码
+	IPs []string `json:"ips,omitempty"`
+	// dns capability，覆盖配置中的dns
+	DNS *types.DNS `json:"dns,omitempty"`
+	// bandwidth capability，优先于pod注解
+	Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
+	// portMappings capability，pod的hostPort
+	PortMappings []PortMapping `json:"portMappings,omitempty"`
+}
+
+// BandwidthEntry 限速配置，rate单位是bit/s，burst单位是bit
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
+// YCNIConfig 插件的完整配置，cniVersion、name、type、dns和prevResult等通用字段在types.NetConf中，
+// dns包括nameservers、domain、search和options，会原样放到结果里
+type YCNIConfig struct {
+	types.NetConf
+	IPAM IPAM `json:"ipam"`
+	// runtime按capabilities注入的参数，在conflist中也会原样传给后面的插件
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig,omitempty"`
+	// iptables或nftables，为空时自动探测
+	Datapath string `json:"datapath,omitempty"`
+	// routed或bridge，为空时是routed
+	Mode string `json:"mode,omitempty"`
+	// 网桥模式下宿主机veth接入的网桥，为空时使用ycnibr0
+	Bridge string `json:"bridge,omitempty"`
+	// pod网卡的类型，veth、ipvlan或macvlan，为空时是veth
+	InterfaceType string `json:"interfaceType,omitempty"`
+	// ipvlan和macvlan的父设备，为空时使用出口网卡
+	Master string `json:"master,omitempty"`
+	// ipvlan的模式，l3或l3s，为空时是l3；macvlan固定使用bridge模式
+	IPVlanMode string `json:"ipvlanMode,omitempty"`
+	// ipvlan和macvlan时宿主机上访问pod用的子接口，为空时使用ycnishim0
+	Shim string `json:"shim,omitempty"`
+	// pod网卡的mtu，由ycnid根据底层网卡mtu和封装开销计算
+	MTU int `json:"mtu,omitempty"`
+	// 出口网卡，由ycnid生成配置时填入，为空时按默认路由探测
+	OutInterface string `json:"outInterface,omitempty"`
+	// 配置后按目的地址做masquerade，访问这些网段不做snat，不再区分出口网卡
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs,omitempty"`
+	// 容器内的路由，没有指定gw时走pod的默认网关，为空时只添加默认路由，可以按pod覆盖
+	Routes []*types.Route `json:"routes,omitempty"`
+	// 访问apiserver用的kubeconfig，配置后才会读取pod注解
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// statefulset的pod重建后使用原来的ip，需要配置kubeconfig，保留记录由ycnid清理
+	StickyIPs bool `json:"stickyIPs,omitempty"`
+	// 跨节点通信的设备，STATUS时检查是否存在并且up，为空时不检查
+	OverlayDevice string `json:"overlayDevice,omitempty"`
+	// ycnid初始化完成后写入的文件，STATUS时检查，为空时不检查
+	ReadyFile string `json:"readyFile,omitempty"`
+	// 在容器内设置的sysctl，只能是net.开头的，可以被pod注解覆盖
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+	// pod注解可以设置的sysctl，支持以*结尾的前缀，为空时使用默认的白名单
+	AllowedSysctls []string `json:"allowedSysctls,omitempty"`
+}
+
+// loadConf 解析stdin中的配置，在conflist中不是第一个插件时还要解析prevResult
+func loadConf(stdin []byte) (*YCNIConfig, error) {
+	conf, err := parseConf(stdin)
+	if err != nil {
+		return nil, err
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, decodingError(err, "解析prevResult失败", "failed to parse prevResult")
+	}
+	return conf, nil
+}
+
+// parseConf 只解析配置，不解析prevResult
+func parseConf(stdin []byte) (*YCNIConfig, error) {
+	conf := &YCNIConfig{}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return nil, decodingError(err, "加载cni配置文件错误", "failed to parse network configuration")
+	}
+	return conf, nil
+}
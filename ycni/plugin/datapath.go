@@ -0,0 +1,203 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"os/exec"
+	"strings"
+	"ycni/log"
+)
+
+const (
+	datapathIPTables = "iptables"
+	datapathNFTables = "nftables"
+)
+
+// datapath 负责pod的转发放行、出方向masquerade和hostPort端口映射
+type datapath interface {
+	setupPod(hostVethName string, podIPs []net.IPNet) error
+	teardownPod(hostVethName string, podIPs []net.IPNet) error
+	setupPortMappings(hostVethName string, podIPs []net.IPNet, mappings []hostportMapping) error
+	teardownPortMappings(hostVethName string) error
+}
+
+// datapathOptions pod转发和masquerade规则的参数
+type datapathOptions struct {
+	// 出口网卡，为空时规则不限制网卡
+	outInterface string
+	// 访问这些网段时不做masquerade，只在按目的地址masquerade时使用
+	nonMasqCIDRs []*net.IPNet
+}
+
+// newDatapathOptions 配置了nonMasqueradeCIDRs时按目的地址做masquerade，不再关心出口网卡；
+// 否则使用配置的出口网卡，没有配置时和ycnid一样按默认路由探测
+func newDatapathOptions(ycniConf *YCNIConfig) (*datapathOptions, error) {
+	if len(ycniConf.NonMasqueradeCIDRs) > 0 {
+		opts := &datapathOptions{}
+		// pod子网之间互访也不做masquerade
+		for _, cidr := range append(ycniConf.IPAM.subnets(), ycniConf.NonMasqueradeCIDRs...) {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "解析nonMasqueradeCIDRs失败: %s", cidr)
+			}
+			opts.nonMasqCIDRs = append(opts.nonMasqCIDRs, ipNet)
+		}
+		return opts, nil
+	}
+
+	outInterface := ycniConf.OutInterface
+	if outInterface == "" {
+		gateway, err := getDefaultGatewayInterface()
+		if err != nil {
+			return nil, errors.Wrap(err, "获取路由出口网卡失败")
+		}
+		outInterface = gateway.Name
+		log.Debugf("自动探测出口网卡: %s", outInterface)
+	}
+	return &datapathOptions{outInterface: outInterface}, nil
+}
+
+// newDatapath 根据配置选择iptables或nftables，没配置时自动探测
+func newDatapath(ycniConf *YCNIConfig) (datapath, error) {
+	opts, err := newDatapathOptions(ycniConf)
+	if err != nil {
+		return nil, err
+	}
+	return newDatapathWithOptions(ycniConf, opts)
+}
+
+// newTeardownDatapath 删除规则时按hostVeth匹配，不需要探测出口网卡，节点重启后默认路由还没配好时也能删除
+func newTeardownDatapath(ycniConf *YCNIConfig) (datapath, error) {
+	return newDatapathWithOptions(ycniConf, &datapathOptions{})
+}
+
+// newFallbackDatapaths 拿不到配置时不知道用的哪种datapath和哪些子网，规则都按hostVeth删除，
+// 建过ycni表的用nftables删，装了iptables或ip6tables的对应地址族用iptables删
+func newFallbackDatapaths() []datapath {
+	var dps []datapath
+	if nftTableExists() {
+		dps = append(dps, &nftablesDatapath{opts: &datapathOptions{}})
+	}
+	var subnets []string
+	for _, c := range []struct {
+		bin    string
+		subnet *net.IPNet
+	}{
+		{"iptables", IPv4AllNet},
+		{"ip6tables", IPv6AllNet},
+	} {
+		if _, err := exec.LookPath(c.bin); err == nil {
+			subnets = append(subnets, c.subnet.String())
+		}
+	}
+	if len(subnets) > 0 {
+		dps = append(dps, &iptablesDatapath{subnets: subnets, opts: &datapathOptions{}})
+	}
+	return dps
+}
+
+func newDatapathWithOptions(ycniConf *YCNIConfig, opts *datapathOptions) (datapath, error) {
+	mode := ycniConf.Datapath
+	if mode == "" {
+		mode = detectDatapath()
+		log.Debugf("自动选择datapath: %s", mode)
+	}
+	switch mode {
+	case datapathIPTables:
+		return &iptablesDatapath{subnets: ycniConf.IPAM.subnets(), opts: opts}, nil
+	case datapathNFTables:
+		return &nftablesDatapath{opts: opts}, nil
+	default:
+		return nil, errors.Errorf("不支持的datapath: %s", mode)
+	}
+}
+
+// detectDatapath 只装了nftables的系统上没有iptables命令
+func detectDatapath() string {
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return datapathIPTables
+	}
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		return datapathIPTables
+	}
+	return datapathNFTables
+}
+
+type iptablesDatapath struct {
+	subnets []string
+	opts    *datapathOptions
+}
+
+func (d *iptablesDatapath) setupPod(hostVethName string, _ []net.IPNet) error {
+	// 双栈时ipv4和ipv6各配一套
+	for _, subnet := range d.subnets {
+		ipt, err := newIPTablesManager(subnet)
+		if err != nil {
+			return err
+		}
+		if err = ipt.addPodRules(hostVethName, subnet, d.opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *iptablesDatapath) teardownPod(hostVethName string, _ []net.IPNet) error {
+	// 子网的masquerade规则其他pod还在用，不删除
+	for _, subnet := range d.subnets {
+		ipt, err := newIPTablesManager(subnet)
+		if err != nil {
+			return err
+		}
+		if err = ipt.delPodRules(hostVethName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *iptablesDatapath) setupPortMappings(hostVethName string, podIPs []net.IPNet, mappings []hostportMapping) error {
+	for _, subnet := range d.familySubnets() {
+		ipt, err := newIPTablesManager(subnet)
+		if err != nil {
+			return err
+		}
+		if err = ipt.addPortMappings(hostVethName, podIPs, mappings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *iptablesDatapath) teardownPortMappings(hostVethName string) error {
+	for _, subnet := range d.familySubnets() {
+		ipt, err := newIPTablesManager(subnet)
+		if err != nil {
+			return err
+		}
+		if err = ipt.delPortMappings(hostVethName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// familySubnets 每个地址族只取一个子网，端口映射的规则和子网无关
+func (d *iptablesDatapath) familySubnets() []string {
+	var subnets []string
+	var hasIpv4, hasIpv6 bool
+	for _, subnet := range d.subnets {
+		if strings.Contains(subnet, ":") {
+			if !hasIpv6 {
+				subnets = append(subnets, subnet)
+			}
+			hasIpv6 = true
+		} else {
+			if !hasIpv4 {
+				subnets = append(subnets, subnet)
+			}
+			hasIpv4 = true
+		}
+	}
+	return subnets
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"strings"
+	"ycni/log"
+)
+
+// 插件自定义的错误码，cni规范中100以上留给插件使用
+const (
+	// 没有可分配的ip
+	errCodeIPAMExhausted uint = 100
+	// 指定的ip已经被占用
+	errCodeIPUnavailable uint = 101
+	// CHECK时容器网络和ADD的结果不一致，例如ip、路由被删掉或者网卡被down
+	errCodeConfigDrift uint = 102
+)
+
+// STATUS使用的错误码，cni 1.1规范中定义
+const (
+	// 插件暂时不能处理ADD
+	errCodePluginNotAvailable uint = 50
+	// 插件不能处理ADD，已有的容器网络也可能不通
+	errCodeLimitedConnectivity uint = 51
+)
+
+// cniError 带cni错误码的错误，msg是返回给runtime的英文描述，
+// err保留原来的中文错误，只写到日志里
+type cniError struct {
+	code    uint
+	msg     string
+	details string
+	err     error
+}
+
+func (e *cniError) Error() string {
+	return e.err.Error()
+}
+
+func (e *cniError) Cause() error {
+	return e.err
+}
+
+func (e *cniError) Unwrap() error {
+	return e.err
+}
+
+// cniDetail 网卡名、ip这类作为details返回给runtime的值
+type cniDetail string
+
+func (d cniDetail) Error() string {
+	return string(d)
+}
+
+// cniDetails 只把系统返回的错误和cniDetail作为details，
+// 插件自己用errors.New/Errorf生成的错误是中文的，只写到日志里
+func cniDetails(err error) string {
+	cause := errors.Cause(err)
+	if _, localized := cause.(interface{ StackTrace() errors.StackTrace }); localized {
+		return ""
+	}
+	return cause.Error()
+}
+
+// newCNIError localized是写到日志里的中文描述，details是最底层的系统错误，
+// err为nil时只用localized生成错误，不会出现空的错误信息。
+// err里已经有分类过的错误时保留里面的错误码和描述，底层的分类更准确，例如xtables锁超时
+func newCNIError(code uint, err error, localized, msg string) error {
+	if err == nil {
+		return &cniError{code: code, msg: msg, err: errors.New(localized)}
+	}
+	var inner *cniError
+	if errors.As(err, &inner) {
+		code, msg = inner.code, inner.msg
+	}
+	return &cniError{code: code, msg: msg, details: cniDetails(err), err: errors.Wrap(err, localized)}
+}
+
+func decodingError(err error, localized, msg string) error {
+	return newCNIError(types.ErrDecodingFailure, err, localized, msg)
+}
+
+func invalidConfigError(err error, localized, msg string) error {
+	return newCNIError(types.ErrInvalidNetworkConfig, err, localized, msg)
+}
+
+func ioError(err error, localized, msg string) error {
+	return newCNIError(types.ErrIOFailure, err, localized, msg)
+}
+
+func internalError(err error, localized, msg string) error {
+	return newCNIError(types.ErrInternal, err, localized, msg)
+}
+
+// tryAgainError 锁超时、apiserver不可用这类暂时的失败，runtime稍后重试可能就成功了
+func tryAgainError(err error, localized, msg string) error {
+	return newCNIError(types.ErrTryAgainLater, err, localized, msg)
+}
+
+// netnsError ns不存在时返回容器不存在，其他按内部错误处理
+func netnsError(err error, localized, msg string) error {
+	var nsErr ns.NSPathNotExistErr
+	if errors.As(err, &nsErr) {
+		return newCNIError(types.ErrUnknownContainer, err, localized, "container network namespace does not exist")
+	}
+	return internalError(err, localized, msg)
+}
+
+// linkError 网卡不存在时和netnsError一样返回容器不存在，其他按内部错误处理
+func linkError(err error, localized, msg string) error {
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return newCNIError(types.ErrUnknownContainer, err, localized, msg)
+	}
+	return internalError(err, localized, msg)
+}
+
+// driftError CHECK发现网络配置和ADD时不一致，和读取配置失败的内部错误区分开
+func driftError(err error, localized, msg string) error {
+	return newCNIError(errCodeConfigDrift, err, localized, msg)
+}
+
+// ipamError 按错误信息区分ip耗尽、指定的ip被占用和其他错误，host-local和内置ipam用的是同一套分配逻辑，错误信息一致。
+// 其他错误多是存储锁超时或者执行host-local失败，按稍后重试处理
+func ipamError(err error, localized string) error {
+	text := ""
+	if err != nil {
+		text = err.Error()
+	}
+	switch {
+	case strings.Contains(text, "no IP addresses available"):
+		return newCNIError(errCodeIPAMExhausted, err, localized, "no IP addresses available in the node's ranges")
+	case strings.Contains(text, "is not available in range set"), strings.Contains(text, "has been allocated to"):
+		return newCNIError(errCodeIPUnavailable, err, localized, "requested IP address is already in use")
+	default:
+		return tryAgainError(err, localized, "failed to allocate IP address")
+	}
+}
+
+// toCNIError 转换成返回给runtime的types.Error，Details是最底层的系统错误，没有错误码的按内部错误处理
+func toCNIError(err error) *types.Error {
+	// 先找自己的错误码，ipam插件返回的types.Error可能被包在里面
+	var ce *cniError
+	if errors.As(err, &ce) {
+		return types.NewError(ce.code, ce.msg, ce.details)
+	}
+	var typed *types.Error
+	if errors.As(err, &typed) {
+		return typed
+	}
+	return types.NewError(types.ErrInternal, "internal error", cniDetails(err))
+}
+
+// withCNIError skel只认*types.Error，其他错误都会变成999，这里统一转换，完整的中文错误写到日志里
+func withCNIError(name string, cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		err := cmd(args)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("%s失败: %s", name, err.Error())
+		return toCNIError(err)
+	}
+}
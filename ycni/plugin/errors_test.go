@@ -0,0 +1,105 @@
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+func TestToCNIErrorCode(t *testing.T) {
+	sysErr := errors.New("resource temporarily unavailable")
+	_, linkNotFound := netlink.LinkByName("ycni-nolink")
+	tests := []struct {
+		name string
+		err  error
+		code uint
+		msg  string
+	}{
+		{name: "decoding", err: decodingError(sysErr, "解析失败", "decode"), code: types.ErrDecodingFailure, msg: "decode"},
+		{name: "invalid config", err: invalidConfigError(sysErr, "配置错误", "config"), code: types.ErrInvalidNetworkConfig, msg: "config"},
+		{name: "io", err: ioError(sysErr, "读写失败", "io"), code: types.ErrIOFailure, msg: "io"},
+		{name: "internal", err: internalError(sysErr, "内部错误", "internal"), code: types.ErrInternal, msg: "internal"},
+		{name: "try again", err: tryAgainError(sysErr, "稍后重试", "again"), code: types.ErrTryAgainLater, msg: "again"},
+		{name: "nil cause", err: tryAgainError(nil, "稍后重试", "again"), code: types.ErrTryAgainLater, msg: "again"},
+		{name: "netns missing", err: netnsError(ns.NSPathNotExistErr{}, "ns不存在", "netns"), code: types.ErrUnknownContainer, msg: "container network namespace does not exist"},
+		{name: "netns other", err: netnsError(sysErr, "ns错误", "netns"), code: types.ErrInternal, msg: "netns"},
+		{name: "link missing", err: linkError(linkNotFound, "没找到ns内的veth: eth0", "container interface not found"), code: types.ErrUnknownContainer, msg: "container interface not found"},
+		{name: "link other", err: linkError(sysErr, "获取网卡失败", "link"), code: types.ErrInternal, msg: "link"},
+		{name: "config drift", err: driftError(cniDetail("10.0.0.5/32"), "容器内veth缺少ip", "container interface is missing an IP address"), code: errCodeConfigDrift, msg: "container interface is missing an IP address"},
+		{
+			name: "inner class kept",
+			err:  internalError(errors.Wrap(tryAgainError(sysErr, "等待xtables锁超时", "timed out waiting for the xtables lock"), "添加规则失败"), "配置转发规则失败", "failed to set up forwarding rules"),
+			code: types.ErrTryAgainLater,
+			msg:  "timed out waiting for the xtables lock",
+		},
+		{
+			name: "ipam exhausted",
+			err:  ipamError(errors.New("no IP addresses available in range set: 10.0.0.1-10.0.0.14"), "分配ip失败"),
+			code: errCodeIPAMExhausted,
+			msg:  "no IP addresses available in the node's ranges",
+		},
+		{
+			name: "ipam requested ip taken",
+			err:  ipamError(errors.New("requested IP address 10.0.0.5 is not available in range set 10.0.0.1-10.0.0.14"), "分配ip失败"),
+			code: errCodeIPUnavailable,
+			msg:  "requested IP address is already in use",
+		},
+		{
+			name: "ipam duplicate allocation",
+			err:  ipamError(errors.New("10.0.0.5 has been allocated to abc, duplicate allocation is not allowed"), "分配ip失败"),
+			code: errCodeIPUnavailable,
+			msg:  "requested IP address is already in use",
+		},
+		{
+			name: "ipam exec failure",
+			err:  ipamError(errors.New("failed to find plugin \"host-local\" in path [/opt/cni/bin]"), "分配ip失败"),
+			code: types.ErrTryAgainLater,
+			msg:  "failed to allocate IP address",
+		},
+		{
+			name: "ipam store lock timeout",
+			err:  ipamError(tryAgainError(nil, "等待ipam存储锁超时", "timed out waiting for the ipam store lock"), "分配ip失败"),
+			code: types.ErrTryAgainLater,
+			msg:  "timed out waiting for the ipam store lock",
+		},
+		{name: "pod not found", err: podLookupError(errors.Wrap(errPodNotFound, "podName: a")), code: types.ErrUnknownContainer, msg: "pod not found"},
+		{name: "apiserver unavailable", err: podLookupError(tryAgainError(sysErr, "apiserver不可用", "apiserver is unavailable")), code: types.ErrTryAgainLater, msg: "apiserver is unavailable"},
+		{name: "kubeconfig", err: podLookupError(errors.Wrap(sysErr, "加载kubeconfig失败")), code: types.ErrInvalidNetworkConfig, msg: "failed to load kubeconfig"},
+		{name: "typed error from ipam plugin", err: errors.Wrap(types.NewError(types.ErrIOFailure, "io", ""), "调用ipam失败"), code: types.ErrIOFailure, msg: "io"},
+		{name: "untyped", err: sysErr, code: types.ErrInternal, msg: "internal error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := toCNIError(tt.err)
+			if got.Code != tt.code || got.Msg != tt.msg {
+				t.Errorf("toCNIError() = %d %q, want %d %q", got.Code, got.Msg, tt.code, tt.msg)
+			}
+		})
+	}
+}
+
+func TestToCNIErrorDetails(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		details string
+	}{
+		{name: "system error", err: internalError(errors.Wrap(unix.EBUSY, "添加路由失败"), "宿主机添加路由失败", "failed"), details: unix.EBUSY.Error()},
+		{name: "value", err: internalError(cniDetail("veth1234"), "hostVeth未up", "host veth is down"), details: "veth1234"},
+		{name: "localized sentinel", err: podLookupError(errors.Wrap(errPodNotFound, "podName: a")), details: ""},
+		{name: "localized root", err: invalidConfigError(errors.Errorf("指定的ip %s 不在本节点可分配的范围内", "10.0.0.5"), "指定的ip不可用", "invalid"), details: ""},
+		{name: "nil cause", err: internalError(nil, "内部错误", "internal"), details: ""},
+		{name: "untyped localized", err: errors.Wrap(errors.New("内部错误"), "失败"), details: ""},
+		{name: "untyped system error", err: errors.Wrap(unix.ENOENT, "失败"), details: unix.ENOENT.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := toCNIError(tt.err).Details; got != tt.details {
+				t.Errorf("toCNIError().Details = %q, want %q", got, tt.details)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"strings"
+)
+
+// PortMapping portMappings capability的格式，kubelet根据pod的hostPort生成
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// hostportMapping 校验后的端口映射
+type hostportMapping struct {
+	hostPort      uint16
+	containerPort uint16
+	// tcp、udp或sctp
+	protocol string
+	// 为空时监听本机所有地址
+	hostIP net.IP
+}
+
+// parsePortMappings 校验端口映射，protocol为空时默认tcp，hostIP为0.0.0.0或::时等同于不指定
+func parsePortMappings(mappings []PortMapping) ([]hostportMapping, error) {
+	var parsed []hostportMapping
+	for _, pm := range mappings {
+		if pm.HostPort <= 0 || pm.HostPort > 65535 || pm.ContainerPort <= 0 || pm.ContainerPort > 65535 {
+			return nil, errors.Errorf("端口映射的端口不合法: %d->%d", pm.HostPort, pm.ContainerPort)
+		}
+		m := hostportMapping{
+			hostPort:      uint16(pm.HostPort),
+			containerPort: uint16(pm.ContainerPort),
+			protocol:      strings.ToLower(pm.Protocol),
+		}
+		switch m.protocol {
+		case "":
+			m.protocol = "tcp"
+		case "tcp", "udp", "sctp":
+		default:
+			return nil, errors.Errorf("端口映射不支持的协议: %s", pm.Protocol)
+		}
+		if pm.HostIP != "" {
+			m.hostIP = net.ParseIP(pm.HostIP)
+			if m.hostIP == nil {
+				return nil, errors.Errorf("端口映射的hostIP不合法: %s", pm.HostIP)
+			}
+			if m.hostIP.IsUnspecified() {
+				m.hostIP = nil
+			}
+		}
+		parsed = append(parsed, m)
+	}
+	return parsed, nil
+}
+
+// matchFamily 指定了hostIP时只在hostIP的地址族上做映射
+func (m *hostportMapping) matchFamily(podIP net.IP) bool {
+	return m.hostIP == nil || (m.hostIP.To4() != nil) == (podIP.To4() != nil)
+}
+
+func (m *hostportMapping) l4proto() byte {
+	switch m.protocol {
+	case "udp":
+		return unix.IPPROTO_UDP
+	case "sctp":
+		return unix.IPPROTO_SCTP
+	default:
+		return unix.IPPROTO_TCP
+	}
+}
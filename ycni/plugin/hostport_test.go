@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParsePortMappings(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings []PortMapping
+		want     []hostportMapping
+		wantErr  bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "default protocol",
+			mappings: []PortMapping{{HostPort: 8080, ContainerPort: 80}},
+			want:     []hostportMapping{{hostPort: 8080, containerPort: 80, protocol: "tcp"}},
+		},
+		{
+			name: "protocols",
+			mappings: []PortMapping{
+				{HostPort: 53, ContainerPort: 53, Protocol: "UDP"},
+				{HostPort: 9999, ContainerPort: 9999, Protocol: "sctp"},
+				{HostPort: 443, ContainerPort: 8443, Protocol: "Tcp"},
+			},
+			want: []hostportMapping{
+				{hostPort: 53, containerPort: 53, protocol: "udp"},
+				{hostPort: 9999, containerPort: 9999, protocol: "sctp"},
+				{hostPort: 443, containerPort: 8443, protocol: "tcp"},
+			},
+		},
+		{
+			name: "host ip",
+			mappings: []PortMapping{
+				{HostPort: 8080, ContainerPort: 80, HostIP: "192.168.1.10"},
+				{HostPort: 8081, ContainerPort: 80, HostIP: "fd00::10"},
+			},
+			want: []hostportMapping{
+				{hostPort: 8080, containerPort: 80, protocol: "tcp", hostIP: net.ParseIP("192.168.1.10")},
+				{hostPort: 8081, containerPort: 80, protocol: "tcp", hostIP: net.ParseIP("fd00::10")},
+			},
+		},
+		{
+			name: "unspecified host ip",
+			mappings: []PortMapping{
+				{HostPort: 8080, ContainerPort: 80, HostIP: "0.0.0.0"},
+				{HostPort: 8081, ContainerPort: 80, HostIP: "::"},
+			},
+			want: []hostportMapping{
+				{hostPort: 8080, containerPort: 80, protocol: "tcp"},
+				{hostPort: 8081, containerPort: 80, protocol: "tcp"},
+			},
+		},
+		{
+			name:     "port range bounds",
+			mappings: []PortMapping{{HostPort: 1, ContainerPort: 65535}},
+			want:     []hostportMapping{{hostPort: 1, containerPort: 65535, protocol: "tcp"}},
+		},
+		{
+			name:     "zero host port",
+			mappings: []PortMapping{{HostPort: 0, ContainerPort: 80}},
+			wantErr:  true,
+		},
+		{
+			name:     "negative container port",
+			mappings: []PortMapping{{HostPort: 8080, ContainerPort: -1}},
+			wantErr:  true,
+		},
+		{
+			name:     "host port too large",
+			mappings: []PortMapping{{HostPort: 65536, ContainerPort: 80}},
+			wantErr:  true,
+		},
+		{
+			name:     "container port too large",
+			mappings: []PortMapping{{HostPort: 8080, ContainerPort: 70000}},
+			wantErr:  true,
+		},
+		{
+			name:     "unsupported protocol",
+			mappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid host ip",
+			mappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, HostIP: "localhost"}},
+			wantErr:  true,
+		},
+		{
+			name: "invalid entry after valid",
+			mappings: []PortMapping{
+				{HostPort: 8080, ContainerPort: 80},
+				{HostPort: 8081, ContainerPort: 0},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePortMappings(tt.mappings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePortMappings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePortMappings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostportMappingMatchFamily(t *testing.T) {
+	podIP, podIP6 := net.ParseIP("10.244.0.5"), net.ParseIP("fd00::5")
+	tests := []struct {
+		hostIP string
+		v4, v6 bool
+	}{
+		{hostIP: "", v4: true, v6: true},
+		{hostIP: "192.168.1.10", v4: true},
+		{hostIP: "fd00::10", v6: true},
+	}
+	for _, tt := range tests {
+		m := hostportMapping{hostIP: net.ParseIP(tt.hostIP)}
+		if got := m.matchFamily(podIP); got != tt.v4 {
+			t.Errorf("matchFamily(%q, %s) = %v, want %v", tt.hostIP, podIP, got, tt.v4)
+		}
+		if got := m.matchFamily(podIP6); got != tt.v6 {
+			t.Errorf("matchFamily(%q, %s) = %v, want %v", tt.hostIP, podIP6, got, tt.v6)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"net"
+	"os"
+	"strings"
+	"ycni/log"
+)
+
+// 只有ycni使用的CNI_ARGS，host-local用types.LoadArgs解析CNI_ARGS，没有IgnoreUnknown=1时遇到不认识的key会报错。
+// kubelet会带上IgnoreUnknown，cnitool和podman等不会，调用ipam插件前要去掉这些key。
+// IP=已经由ycni检查过并合并到runtimeConfig的ips里，再传给host-local会绕过ycni的检查重复请求
+var ycniOnlyArgs = map[string]bool{
+	"ROUTES": true,
+	"IP":     true,
+}
+
+// ipamArgs 去掉只有ycni使用的key，其他的原样传给ipam插件
+func ipamArgs(args string) string {
+	var kept []string
+	for _, attr := range strings.Split(args, ";") {
+		if attr == "" || ycniOnlyArgs[strings.SplitN(attr, "=", 2)[0]] {
+			continue
+		}
+		kept = append(kept, attr)
+	}
+	return strings.Join(kept, ";")
+}
+
+// setIPAMArgs ipam插件从环境变量中读取CNI_ARGS
+func setIPAMArgs() error {
+	return os.Setenv("CNI_ARGS", ipamArgs(os.Getenv("CNI_ARGS")))
+}
+
+// rangeSets 返回配置的所有range set，没有配置ranges时由subnet和subnet6生成
+func (i *IPAM) rangeSets() [][]IPRange {
+	if len(i.Ranges) > 0 {
+		return i.Ranges
+	}
+	sets := [][]IPRange{{{Subnet: i.Subnet, RangeStart: i.RangeStart, RangeEnd: i.RangeEnd}}}
+	// 双栈时再加一个ipv6的range set，每个range set分配一个ip
+	if i.Subnet6 != "" {
+		sets = append(sets, []IPRange{{Subnet: i.Subnet6, RangeStart: i.RangeStart6, RangeEnd: i.RangeEnd6}})
+	}
+	return sets
+}
+
+// subnets 返回所有range的子网，去掉重复的
+func (i *IPAM) subnets() []string {
+	var subnets []string
+	seen := make(map[string]bool)
+	for _, set := range i.rangeSets() {
+		for _, r := range set {
+			if r.Subnet == "" || seen[r.Subnet] {
+				continue
+			}
+			seen[r.Subnet] = true
+			subnets = append(subnets, r.Subnet)
+		}
+	}
+	return subnets
+}
+
+// parseRange 把配置里的子网和起止ip转换成host-local的range
+func parseRange(subnet, rangeStart, rangeEnd string) (*allocator.Range, error) {
+	ipNet, err := types.ParseCIDR(subnet)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse子网失败: %s", subnet)
+	}
+	r := &allocator.Range{Subnet: types.IPNet(*ipNet)}
+	if rangeStart != "" {
+		r.RangeStart = net.ParseIP(rangeStart)
+		if r.RangeStart == nil {
+			return nil, errors.Errorf("获取起始ip失败: %s", rangeStart)
+		}
+	}
+	if rangeEnd != "" {
+		r.RangeEnd = net.ParseIP(rangeEnd)
+		if r.RangeEnd == nil {
+			return nil, errors.Errorf("获取结束ip失败: %s", rangeEnd)
+		}
+	}
+	return r, nil
+}
+
+// buildIPAMConf 生成ipam配置，add和del需要使用同一份配置
+func buildIPAMConf(ycniConf *YCNIConfig) (*allocator.Net, error) {
+	exclude, err := parseExclude(ycniConf.IPAM.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []allocator.RangeSet
+	for _, set := range ycniConf.IPAM.rangeSets() {
+		var rangeSet allocator.RangeSet
+		for _, ipRange := range set {
+			r, err := parseRange(ipRange.Subnet, ipRange.RangeStart, ipRange.RangeEnd)
+			if err != nil {
+				return nil, err
+			}
+			// 补全起止ip后才能按排除的地址切分
+			if err = r.Canonicalize(); err != nil {
+				return nil, errors.Wrapf(err, "ipam range配置错误: %s", ipRange.Subnet)
+			}
+			rangeSet = append(rangeSet, excludeFromRange(*r, exclude)...)
+		}
+		if len(rangeSet) == 0 {
+			return nil, errors.Errorf("range set中的ip都被排除了: %+v", set)
+		}
+		ranges = append(ranges, rangeSet)
+	}
+
+	return &allocator.Net{
+		Name:       ycniConf.Name,
+		CNIVersion: ycniConf.CNIVersion,
+		IPAM: &allocator.IPAMConfig{
+			Type:    ycniConf.IPAM.Type,
+			Ranges:  ranges,
+			DataDir: ycniConf.IPAM.DataDir,
+		},
+	}, nil
+}
+
+// parseExclude 支持单个ip和网段
+func parseExclude(exclude []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, e := range exclude {
+		if !strings.Contains(e, "/") {
+			addr := net.ParseIP(e)
+			if addr == nil {
+				return nil, errors.Errorf("解析exclude失败: %s", e)
+			}
+			bits := 8 * net.IPv6len
+			if addr.To4() != nil {
+				addr, bits = addr.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "解析exclude失败: %s", e)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// excludeFromRange 把排除的地址从range中挖掉，切成多段range，
+// 这样host-local和内置ipam都不需要额外支持exclude
+func excludeFromRange(r allocator.Range, exclude []*net.IPNet) []allocator.Range {
+	segments := []allocator.Range{r}
+	for _, ex := range exclude {
+		exStart := ex.IP.Mask(ex.Mask)
+		if len(exStart) != len(r.RangeStart) {
+			// 不是同一个地址族
+			continue
+		}
+		exEnd := make(net.IP, len(exStart))
+		for i := range exStart {
+			exEnd[i] = exStart[i] | ^ex.Mask[i]
+		}
+
+		var next []allocator.Range
+		for _, seg := range segments {
+			if ip.Cmp(exEnd, seg.RangeStart) < 0 || ip.Cmp(exStart, seg.RangeEnd) > 0 {
+				next = append(next, seg)
+				continue
+			}
+			if ip.Cmp(exStart, seg.RangeStart) > 0 {
+				left := seg
+				left.RangeEnd = ip.PrevIP(exStart)
+				next = append(next, left)
+			}
+			if ip.Cmp(exEnd, seg.RangeEnd) < 0 {
+				right := seg
+				right.RangeStart = ip.NextIP(exEnd)
+				next = append(next, right)
+			}
+		}
+		segments = next
+	}
+	return segments
+}
+
+// requestedIPs 收集pod指定的ip，来源有runtimeConfig的ips capability、CNI_ARGS的IP=和pod注解，
+// 和host-local一样几个来源取并集
+func requestedIPs(ycniConf *YCNIConfig, cniargs *cniArgs, pod *v1.Pod) ([]*ip.IP, error) {
+	values := append([]string{}, ycniConf.RuntimeConfig.IPs...)
+	if cniargs.ip != "" {
+		values = append(values, cniargs.ip)
+	}
+	if pod != nil && pod.Annotations[ycniIPAnnotationKey] != "" {
+		values = append(values, strings.Split(pod.Annotations[ycniIPAnnotationKey], ",")...)
+	}
+
+	var ips []*ip.IP
+	seen := make(map[string]bool)
+	for _, v := range values {
+		addr := ip.ParseIP(strings.TrimSpace(v))
+		if addr == nil {
+			return nil, errors.Errorf("解析指定的ip失败: %s", v)
+		}
+		if seen[addr.ToIP().String()] {
+			continue
+		}
+		seen[addr.ToIP().String()] = true
+		ips = append(ips, addr)
+	}
+	if len(ips) > 0 {
+		log.Debugf("pod指定的ip: %v", ips)
+	}
+	return ips, nil
+}
+
+// matchRequestedIPs 找到每个指定的ip所在的range set，
+// ip不在本节点可分配的范围内，或者一个range set指定了多个ip时报错。
+// sticky是statefulset pod之前保留的ip，优先级低于指定的ip，已经不在范围内的直接忽略
+func matchRequestedIPs(ipamConf *allocator.Net, requested, sticky []*ip.IP) (map[int]net.IP, error) {
+	matched := make(map[int]net.IP)
+	for _, r := range requested {
+		addr := r.ToIP()
+		idx := rangeSetFor(ipamConf, addr)
+		if idx < 0 {
+			return nil, errors.Errorf("指定的ip %s 不在本节点可分配的范围内", addr)
+		}
+		if prev, ok := matched[idx]; ok {
+			return nil, errors.Errorf("指定的ip %s 和 %s 在同一个range set中，每个range set只能分配一个ip", prev, addr)
+		}
+		matched[idx] = addr
+	}
+	for _, s := range sticky {
+		addr := s.ToIP()
+		idx := rangeSetFor(ipamConf, addr)
+		if idx < 0 {
+			log.Debugf("保留的ip %s 不在本节点可分配的范围内, 忽略", addr)
+			continue
+		}
+		if _, ok := matched[idx]; !ok {
+			matched[idx] = addr
+		}
+	}
+	return matched, nil
+}
+
+// rangeSetFor 返回ip所在range set的下标，不在任何range set中时返回-1
+func rangeSetFor(ipamConf *allocator.Net, addr net.IP) int {
+	for i := range ipamConf.IPAM.Ranges {
+		if ipamConf.IPAM.Ranges[i].Contains(addr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ipamAdd 分配ip，ipam.type为ycni时在进程内分配，否则调用对应的ipam插件
+func ipamAdd(ycniConf *YCNIConfig, args *skel.CmdArgs, requested, sticky []*ip.IP) (*types100.Result, error) {
+	ipamConf, err := buildIPAMConf(ycniConf)
+	if err != nil {
+		return nil, invalidConfigError(err, "获取ipam配置失败", "invalid ipam configuration")
+	}
+	matched, err := matchRequestedIPs(ipamConf, requested, sticky)
+	if err != nil {
+		return nil, invalidConfigError(err, "指定的ip不可用", "requested IP address is outside the node's ranges")
+	}
+	if ycniConf.IPAM.Type == ycniIPAMType {
+		result, err := allocateIPs(ipamConf, matched, args.ContainerID, args.IfName)
+		if err != nil {
+			return nil, ipamError(err, "给ns分配ip失败")
+		}
+		return result, nil
+	}
+	// host-local通过runtimeConfig的ips分配指定的ip
+	ipamConf.RuntimeConfig.IPs = nil
+	for _, addr := range matched {
+		ipamConf.RuntimeConfig.IPs = append(ipamConf.RuntimeConfig.IPs, &ip.IP{IPNet: net.IPNet{IP: addr}})
+	}
+
+	ipamConfBytes, err := json.Marshal(ipamConf)
+	if err != nil {
+		return nil, internalError(err, "获取ipam配置失败", "failed to encode ipam configuration")
+	}
+	log.Debugf("ipam配置：%s", string(ipamConfBytes))
+	if err = setIPAMArgs(); err != nil {
+		return nil, internalError(err, "设置CNI_ARGS失败", "failed to set CNI_ARGS for ipam")
+	}
+	ipamResult, err := ipam.ExecAdd(ycniConf.IPAM.Type, ipamConfBytes)
+	if err != nil {
+		return nil, ipamError(err, "给ns分配ip失败")
+	}
+	// 获取具体的ipam result
+	result, err := types100.GetResult(ipamResult)
+	if err != nil {
+		return nil, decodingError(err, "转化ipam result失败", "failed to convert ipam result")
+	}
+	return result, nil
+}
+
+// ipamDel 释放ip，ADD之后range被修改或者删掉了也要能释放
+func ipamDel(ycniConf *YCNIConfig, args *skel.CmdArgs) error {
+	ipamConf, err := buildIPAMConf(ycniConf)
+	if err != nil {
+		log.Debugf("获取ipam配置失败, 按容器id释放ip: %s", err.Error())
+		return releaseWithoutRanges(ycniConf, args)
+	}
+	if ycniConf.IPAM.Type == ycniIPAMType {
+		if err = releaseIPs(ipamConf, args.ContainerID, args.IfName); err != nil {
+			return internalError(err, "释放ip失败", "failed to release IP address")
+		}
+		return nil
+	}
+
+	ipamConfBytes, err := json.Marshal(ipamConf)
+	if err != nil {
+		return internalError(err, "获取ipam配置失败", "failed to encode ipam configuration")
+	}
+	log.Debugf("ipam配置：%s", string(ipamConfBytes))
+	if err = setIPAMArgs(); err != nil {
+		return internalError(err, "设置CNI_ARGS失败", "failed to set CNI_ARGS for ipam")
+	}
+	if err = ipam.ExecDel(ycniConf.IPAM.Type, ipamConfBytes); err != nil {
+		return tryAgainError(err, "释放ip失败", "failed to release IP address")
+	}
+	return nil
+}
+
+// releaseWithoutRanges range配置不可用时释放ip。内置ipam和host-local的存储只按网络名和目录区分，
+// 直接在存储里按容器id和网卡名删除，没有分配记录时不报错；其他ipam插件把原始的ipam配置传过去
+func releaseWithoutRanges(ycniConf *YCNIConfig, args *skel.CmdArgs) error {
+	if ycniConf.IPAM.Type == ycniIPAMType || ycniConf.IPAM.Type == "host-local" {
+		ipamConf := &allocator.Net{
+			Name:       ycniConf.Name,
+			CNIVersion: ycniConf.CNIVersion,
+			IPAM: &allocator.IPAMConfig{
+				Type:    ycniConf.IPAM.Type,
+				DataDir: ycniConf.IPAM.DataDir,
+			},
+		}
+		if err := releaseIPs(ipamConf, args.ContainerID, args.IfName); err != nil {
+			return internalError(err, "释放ip失败", "failed to release IP address")
+		}
+		return nil
+	}
+
+	ipamConfBytes, err := json.Marshal(&struct {
+		Name       string `json:"name"`
+		CNIVersion string `json:"cniVersion"`
+		IPAM       IPAM   `json:"ipam"`
+	}{ycniConf.Name, ycniConf.CNIVersion, ycniConf.IPAM})
+	if err != nil {
+		return internalError(err, "获取ipam配置失败", "failed to encode ipam configuration")
+	}
+	log.Debugf("ipam配置：%s", string(ipamConfBytes))
+	if err = setIPAMArgs(); err != nil {
+		return internalError(err, "设置CNI_ARGS失败", "failed to set CNI_ARGS for ipam")
+	}
+	if err = ipam.ExecDel(ycniConf.IPAM.Type, ipamConfBytes); err != nil {
+		return tryAgainError(err, "释放ip失败", "failed to release IP address")
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"reflect"
+	"testing"
+)
+
+func mustRange(t *testing.T, subnet string) allocator.Range {
+	t.Helper()
+	r, err := parseRange(subnet, "", "")
+	if err != nil {
+		t.Fatalf("parseRange(%s): %v", subnet, err)
+	}
+	if err = r.Canonicalize(); err != nil {
+		t.Fatalf("Canonicalize(%s): %v", subnet, err)
+	}
+	return *r
+}
+
+func rangeStrings(ranges []allocator.Range) []string {
+	var out []string
+	for _, r := range ranges {
+		out = append(out, fmt.Sprintf("%s-%s", r.RangeStart, r.RangeEnd))
+	}
+	return out
+}
+
+func TestParseExclude(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "single ipv4", exclude: []string{"10.0.0.1"}, want: []string{"10.0.0.1/32"}},
+		{name: "single ipv6", exclude: []string{"fd00::1"}, want: []string{"fd00::1/128"}},
+		{name: "cidr", exclude: []string{"10.0.0.5/30"}, want: []string{"10.0.0.4/30"}},
+		{name: "mixed", exclude: []string{"10.0.0.1", "fd00::/120"}, want: []string{"10.0.0.1/32", "fd00::/120"}},
+		{name: "invalid ip", exclude: []string{"10.0.0.300"}, wantErr: true},
+		{name: "invalid cidr", exclude: []string{"10.0.0.0/33"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseExclude(tt.exclude)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExclude(%v) error = %v, wantErr %v", tt.exclude, err, tt.wantErr)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseExclude(%v) = %v, want %v", tt.exclude, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcludeFromRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnet  string
+		exclude []string
+		want    []string
+	}{
+		{
+			name:   "no exclude",
+			subnet: "10.0.0.0/28",
+			want:   []string{"10.0.0.1-10.0.0.14"},
+		},
+		{
+			name:    "first address",
+			subnet:  "10.0.0.0/28",
+			exclude: []string{"10.0.0.1"},
+			want:    []string{"10.0.0.2-10.0.0.14"},
+		},
+		{
+			name:    "last address",
+			subnet:  "10.0.0.0/28",
+			exclude: []string{"10.0.0.14"},
+			want:    []string{"10.0.0.1-10.0.0.13"},
+		},
+		{
+			name:    "middle block",
+			subnet:  "10.0.0.0/28",
+			exclude: []string{"10.0.0.4/30"},
+			want:    []string{"10.0.0.1-10.0.0.3", "10.0.0.8-10.0.0.14"},
+		},
+		{
+			name:    "overlapping excludes",
+			subnet:  "10.0.0.0/28",
+			exclude: []string{"10.0.0.4/30", "10.0.0.6/31", "10.0.0.8"},
+			want:    []string{"10.0.0.1-10.0.0.3", "10.0.0.9-10.0.0.14"},
+		},
+		{
+			name:    "adjacent excludes",
+			subnet:  "10.0.0.0/28",
+			exclude: []string{"10.0.0.2", "10.0.0.3"},
+			want:    []string{"10.0.0.1-10.0.0.1", "10.0.0.4-10.0.0.14"},
+		},
+		{
+			name:    "covers whole range",
+			subnet:  "10.0.0.0/28",
+			exclude: []string{"10.0.0.0/24"},
+		},
+		{
+			name:    "outside range",
+			subnet:  "10.0.0.0/28",
+			exclude: []string{"10.0.1.0/24"},
+			want:    []string{"10.0.0.1-10.0.0.14"},
+		},
+		{
+			name:    "other family ignored",
+			subnet:  "10.0.0.0/28",
+			exclude: []string{"fd00::1"},
+			want:    []string{"10.0.0.1-10.0.0.14"},
+		},
+		{
+			name:    "ipv6 middle block",
+			subnet:  "fd00::/120",
+			exclude: []string{"fd00::10/124"},
+			want:    []string{"fd00::1-fd00::f", "fd00::20-fd00::ff"},
+		},
+		{
+			name:    "ipv6 edges",
+			subnet:  "fd00::/120",
+			exclude: []string{"fd00::1", "fd00::ff"},
+			want:    []string{"fd00::2-fd00::fe"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exclude, err := parseExclude(tt.exclude)
+			if err != nil {
+				t.Fatalf("parseExclude(%v): %v", tt.exclude, err)
+			}
+			got := rangeStrings(excludeFromRange(mustRange(t, tt.subnet), exclude))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("excludeFromRange(%s, %v) = %v, want %v", tt.subnet, tt.exclude, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildIPAMConf(t *testing.T) {
+	tests := []struct {
+		name    string
+		ipam    IPAM
+		want    [][]string
+		wantErr bool
+	}{
+		{
+			name: "subnet",
+			ipam: IPAM{Type: "host-local", Subnet: "10.0.0.0/28"},
+			want: [][]string{{"10.0.0.1-10.0.0.14"}},
+		},
+		{
+			name: "dual stack",
+			ipam: IPAM{Type: "host-local", Subnet: "10.0.0.0/28", Subnet6: "fd00::/124"},
+			want: [][]string{{"10.0.0.1-10.0.0.14"}, {"fd00::1-fd00::f"}},
+		},
+		{
+			name: "range start and end",
+			ipam: IPAM{Type: ycniIPAMType, Subnet: "10.0.0.0/24", RangeStart: "10.0.0.10", RangeEnd: "10.0.0.20", Exclude: []string{"10.0.0.15"}},
+			want: [][]string{{"10.0.0.10-10.0.0.14", "10.0.0.16-10.0.0.20"}},
+		},
+		{
+			name: "ranges with exclude",
+			ipam: IPAM{
+				Type: ycniIPAMType,
+				Ranges: [][]IPRange{
+					{{Subnet: "10.0.0.0/28"}, {Subnet: "10.0.1.0/28"}},
+					{{Subnet: "fd00::/124"}},
+				},
+				Exclude: []string{"10.0.0.0/28", "10.0.1.1", "fd00::8/125"},
+			},
+			want: [][]string{{"10.0.1.2-10.0.1.14"}, {"fd00::1-fd00::7"}},
+		},
+		{
+			name:    "range set fully excluded",
+			ipam:    IPAM{Type: "host-local", Subnet: "10.0.0.0/28", Exclude: []string{"10.0.0.0/28"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid subnet",
+			ipam:    IPAM{Type: "host-local", Subnet: "10.0.0.0/40"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid exclude",
+			ipam:    IPAM{Type: "host-local", Subnet: "10.0.0.0/28", Exclude: []string{"foo"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &YCNIConfig{IPAM: tt.ipam}
+			conf.Name = "ycni0"
+			got, err := buildIPAMConf(conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildIPAMConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var sets [][]string
+			for _, set := range got.IPAM.Ranges {
+				sets = append(sets, rangeStrings(set))
+			}
+			if !reflect.DeepEqual(sets, tt.want) {
+				t.Errorf("buildIPAMConf() ranges = %v, want %v", sets, tt.want)
+			}
+			if got.Name != "ycni0" || got.IPAM.Type != tt.ipam.Type {
+				t.Errorf("buildIPAMConf() name/type = %s/%s", got.Name, got.IPAM.Type)
+			}
+		})
+	}
+}
+
+func TestIPAMDelWithoutRanges(t *testing.T) {
+	for _, ipamType := range []string{ycniIPAMType, "host-local"} {
+		t.Run(ipamType, func(t *testing.T) {
+			conf := &YCNIConfig{IPAM: IPAM{Type: ycniIPAMType, Subnet: "10.0.0.0/28", DataDir: t.TempDir()}}
+			conf.Name = "ycni0"
+			args := &skel.CmdArgs{ContainerID: "abc", IfName: "eth0"}
+			if _, err := ipamAdd(conf, args, nil, nil); err != nil {
+				t.Fatalf("ipamAdd() error = %v", err)
+			}
+			ipamConf, err := buildIPAMConf(conf)
+			if err != nil {
+				t.Fatalf("buildIPAMConf() error = %v", err)
+			}
+
+			// ADD之后range被改坏了，DEL还要能按容器id释放
+			broken := *conf
+			broken.IPAM.Type = ipamType
+			broken.IPAM.Subnet = "10.0.0.0/40"
+			if err = ipamDel(&broken, args); err != nil {
+				t.Fatalf("ipamDel() error = %v", err)
+			}
+			allocations, err := listAllocations(ipamConf)
+			if err != nil {
+				t.Fatalf("listAllocations() error = %v", err)
+			}
+			if len(allocations) != 0 {
+				t.Errorf("ipamDel()之后还有分配记录: %v", allocations)
+			}
+			// 没有分配记录时重复DEL不报错
+			if err = ipamDel(&broken, args); err != nil {
+				t.Errorf("ipamDel()重复调用 error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ycni的规则都放在自己的链里，内置链中只保留一条跳转规则
+const (
+	ycniForwardChain     = "YCNI-FORWARD"
+	ycniPostroutingChain = "YCNI-POSTROUTING"
+	// 访问本机地址的包先进这个链，再跳到每个pod自己的dnat链
+	ycniHostportsChain = "YCNI-HOSTPORTS"
+	// 每个pod的端口映射放在自己的链里，del时整条链删除，不需要知道原来的映射
+	ycniPodDNATChainPrefix = "YCNI-DN-"
+	ycniPodSNATChainPrefix = "YCNI-SN-"
+	// 等待xtables锁的超时时间(秒)，相当于iptables -w 5
+	iptablesLockTimeout = 5
+	// 等锁超时时iptables的退出码，和内存不足等资源问题共用
+	iptablesExitResourceProblem = 4
+)
+
+type iptablesManager struct {
+	ipt *iptables.IPTables
+}
+
+// newIPTablesManager 根据子网的地址族创建iptables或ip6tables的规则管理
+func newIPTablesManager(subnet string) (*iptablesManager, error) {
+	proto := iptables.ProtocolIPv4
+	if strings.Contains(subnet, ":") {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.New(iptables.IPFamily(proto), iptables.Timeout(iptablesLockTimeout))
+	if err != nil {
+		return nil, errors.Wrap(err, "初始化iptables失败")
+	}
+	return &iptablesManager{ipt: ipt}, nil
+}
+
+// iptablesError 其他进程一直占着xtables锁时让runtime稍后重试，其他错误原样包装
+func iptablesError(err error, format string, args ...interface{}) error {
+	wrapped := errors.Wrapf(err, format, args...)
+	var iptErr *iptables.Error
+	if errors.As(err, &iptErr) && iptErr.ExitStatus() == iptablesExitResourceProblem && strings.Contains(iptErr.Error(), "xtables lock") {
+		return tryAgainError(wrapped, "等待xtables锁超时", "timed out waiting for the xtables lock")
+	}
+	return wrapped
+}
+
+// ensureChains 创建ycni的链并在内置链最前面插入跳转规则，可以重复调用
+func (m *iptablesManager) ensureChains() error {
+	for _, c := range []struct {
+		table, chain, parent string
+	}{
+		{"filter", ycniForwardChain, "FORWARD"},
+		{"nat", ycniPostroutingChain, "POSTROUTING"},
+	} {
+		if err := m.ensureChain(c.table, c.chain); err != nil {
+			return err
+		}
+		if err := m.insertUnique(c.table, c.parent, "-m", "comment", "--comment", "ycni", "-j", c.chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *iptablesManager) ensureChain(table, chain string) error {
+	exists, err := m.ipt.ChainExists(table, chain)
+	if err != nil {
+		return iptablesError(err, "检查链%s/%s失败", table, chain)
+	}
+	if exists {
+		return nil
+	}
+	if err = m.ipt.NewChain(table, chain); err != nil {
+		// 并发的ADD可能已经把链建好了
+		if exists, _ = m.ipt.ChainExists(table, chain); exists {
+			return nil
+		}
+		return iptablesError(err, "创建链%s/%s失败", table, chain)
+	}
+	return nil
+}
+
+func (m *iptablesManager) chainsExist(table string, chains ...string) (bool, error) {
+	for _, chain := range chains {
+		exists, err := m.ipt.ChainExists(table, chain)
+		if err != nil {
+			return false, iptablesError(err, "检查链%s/%s失败", table, chain)
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *iptablesManager) insertUnique(table, chain string, rulespec ...string) error {
+	exists, err := m.ipt.Exists(table, chain, rulespec...)
+	if err != nil {
+		return iptablesError(err, "检查%s/%s规则失败: %v", table, chain, rulespec)
+	}
+	if exists {
+		return nil
+	}
+	if err = m.ipt.Insert(table, chain, 1, rulespec...); err != nil {
+		return iptablesError(err, "添加%s/%s规则失败: %v", table, chain, rulespec)
+	}
+	return nil
+}
+
+func (m *iptablesManager) appendUnique(table, chain string, rulespec ...string) error {
+	exists, err := m.ipt.Exists(table, chain, rulespec...)
+	if err != nil {
+		return iptablesError(err, "检查%s/%s规则失败: %v", table, chain, rulespec)
+	}
+	if exists {
+		return nil
+	}
+	if err = m.ipt.Append(table, chain, rulespec...); err != nil {
+		return iptablesError(err, "添加%s/%s规则失败: %v", table, chain, rulespec)
+	}
+	return nil
+}
+
+// podForwardRules 放行容器veth和出口网卡之间的转发，带上veth名的注释方便排查
+// 没有指定出口网卡时不限制网卡
+func podForwardRules(hostVethName, outInterface string) [][]string {
+	comment := "ycni: " + hostVethName
+	if outInterface == "" {
+		return [][]string{
+			{"--in-interface", hostVethName, "-m", "comment", "--comment", comment, "-j", "ACCEPT"},
+			{"--out-interface", hostVethName, "-m", "comment", "--comment", comment, "-j", "ACCEPT"},
+		}
+	}
+	return [][]string{
+		{"--in-interface", hostVethName, "--out-interface", outInterface, "-m", "comment", "--comment", comment, "-j", "ACCEPT"},
+		{"--in-interface", outInterface, "--out-interface", hostVethName, "-m", "comment", "--comment", comment, "-j", "ACCEPT"},
+		// 其他pod或者pod自己访问hostPort时，dnat后的包不是从出口网卡进来的
+		{"--out-interface", hostVethName, "-m", "conntrack", "--ctstate", "DNAT", "-m", "comment", "--comment", comment, "-j", "ACCEPT"},
+	}
+}
+
+// masqueradeRule 整个子网共用一条snat规则，不随pod删除
+func masqueradeRule(subnet, outInterface string) []string {
+	if outInterface == "" {
+		return []string{"--source", subnet, "-m", "comment", "--comment", "ycni: " + subnet, "-j", "MASQUERADE"}
+	}
+	return []string{"--source", subnet, "--out-interface", outInterface, "-m", "comment", "--comment", "ycni: " + subnet, "-j", "MASQUERADE"}
+}
+
+// nonMasqueradeRules 访问这些网段时直接return，不走后面的masquerade
+func nonMasqueradeRules(subnet string, cidrs []*net.IPNet) [][]string {
+	isIPv6 := strings.Contains(subnet, ":")
+	var rules [][]string
+	for _, cidr := range cidrs {
+		if (cidr.IP.To4() == nil) != isIPv6 {
+			continue
+		}
+		rules = append(rules, []string{"--source", subnet, "--destination", cidr.String(), "-m", "comment", "--comment", "ycni: " + subnet, "-j", "RETURN"})
+	}
+	return rules
+}
+
+// addPodRules 添加pod的forward规则和子网的masquerade规则，已存在的规则不会重复添加
+func (m *iptablesManager) addPodRules(hostVethName, subnet string, opts *datapathOptions) error {
+	if err := m.ensureChains(); err != nil {
+		return err
+	}
+	for _, rule := range podForwardRules(hostVethName, opts.outInterface) {
+		if err := m.appendUnique("filter", ycniForwardChain, rule...); err != nil {
+			return err
+		}
+	}
+	// return规则要在masquerade规则前面，所以插到链的最前面
+	for _, rule := range nonMasqueradeRules(subnet, opts.nonMasqCIDRs) {
+		if err := m.insertUnique("nat", ycniPostroutingChain, rule...); err != nil {
+			return err
+		}
+	}
+	return m.appendUnique("nat", ycniPostroutingChain, masqueradeRule(subnet, opts.outInterface)...)
+}
+
+// delPodRules 按注释删除pod的forward规则，出口网卡变了或者探测不到时也能删干净，规则或链不存在时直接返回
+func (m *iptablesManager) delPodRules(hostVethName string) error {
+	exists, err := m.ipt.ChainExists("filter", ycniForwardChain)
+	if err != nil {
+		return iptablesError(err, "检查链%s失败", ycniForwardChain)
+	}
+	if !exists {
+		return nil
+	}
+	rules, err := m.ipt.List("filter", ycniForwardChain)
+	if err != nil {
+		return iptablesError(err, "获取链%s的规则失败", ycniForwardChain)
+	}
+	comment := `--comment "ycni: ` + hostVethName + `"`
+	for _, rule := range rules {
+		if !strings.Contains(rule, comment) {
+			continue
+		}
+		// -S输出的第一项是-A <chain>，后面才是规则
+		spec := splitRuleSpec(rule)
+		if len(spec) < 3 {
+			continue
+		}
+		if err = m.ipt.DeleteIfExists("filter", ycniForwardChain, spec[2:]...); err != nil {
+			return iptablesError(err, "删除forward规则失败: %s", rule)
+		}
+	}
+	return nil
+}
+
+// splitRuleSpec 按空格拆分iptables -S输出的规则，双引号里的空格不拆分
+func splitRuleSpec(rule string) []string {
+	var fields []string
+	var cur strings.Builder
+	inQuote, hasField := false, false
+	for _, r := range rule {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			hasField = true
+		case r == ' ' && !inQuote:
+			if hasField {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				hasField = false
+			}
+		default:
+			cur.WriteRune(r)
+			hasField = true
+		}
+	}
+	if hasField {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+// podHostportChains hostVeth名最长15个字符，加上前缀也不超过iptables链名的长度限制
+func podHostportChains(hostVethName string) (string, string) {
+	return ycniPodDNATChainPrefix + hostVethName, ycniPodSNATChainPrefix + hostVethName
+}
+
+// addPortMappings 在pod的链里添加dnat规则，以及pod访问自己hostPort时的snat规则，重复调用时重建pod的链
+func (m *iptablesManager) addPortMappings(hostVethName string, podIPs []net.IPNet, mappings []hostportMapping) error {
+	if err := m.ensureChains(); err != nil {
+		return err
+	}
+	if err := m.ensureChain("nat", ycniHostportsChain); err != nil {
+		return err
+	}
+	// 外部访问走PREROUTING，本机访问走OUTPUT
+	for _, parent := range []string{"PREROUTING", "OUTPUT"} {
+		if err := m.insertUnique("nat", parent, "-m", "addrtype", "--dst-type", "LOCAL", "-m", "comment", "--comment", "ycni", "-j", ycniHostportsChain); err != nil {
+			return err
+		}
+	}
+
+	dnatChain, snatChain := podHostportChains(hostVethName)
+	for _, chain := range []string{dnatChain, snatChain} {
+		// 链不存在时创建，存在时清空
+		if err := m.ipt.ClearChain("nat", chain); err != nil {
+			return iptablesError(err, "清空链nat/%s失败", chain)
+		}
+	}
+	isIPv6 := m.ipt.Proto() == iptables.ProtocolIPv6
+	for _, podIP := range podIPs {
+		if (podIP.IP.To4() == nil) != isIPv6 {
+			continue
+		}
+		for _, pm := range mappings {
+			if !pm.matchFamily(podIP.IP) {
+				continue
+			}
+			dnat := []string{"-p", pm.protocol}
+			if pm.hostIP != nil {
+				dnat = append(dnat, "-d", pm.hostIP.String())
+			}
+			dnat = append(dnat, "--dport", strconv.Itoa(int(pm.hostPort)),
+				"-j", "DNAT", "--to-destination", net.JoinHostPort(podIP.IP.String(), strconv.Itoa(int(pm.containerPort))))
+			if err := m.ipt.Append("nat", dnatChain, dnat...); err != nil {
+				return iptablesError(err, "添加dnat规则失败: %v", dnat)
+			}
+			// pod访问自己的hostPort时，dnat后源和目的都是自己，要snat成宿主机的地址回包才会经过宿主机
+			snat := []string{"-s", podIP.IP.String(), "-d", podIP.IP.String(), "-p", pm.protocol,
+				"--dport", strconv.Itoa(int(pm.containerPort)), "-j", "MASQUERADE"}
+			if err := m.ipt.Append("nat", snatChain, snat...); err != nil {
+				return iptablesError(err, "添加snat规则失败: %v", snat)
+			}
+		}
+	}
+
+	comment := "ycni: " + hostVethName
+	if err := m.appendUnique("nat", ycniHostportsChain, "-m", "comment", "--comment", comment, "-j", dnatChain); err != nil {
+		return err
+	}
+	// 要在子网的return和masquerade规则前面
+	return m.insertUnique("nat", ycniPostroutingChain, "-m", "comment", "--comment", comment, "-j", snatChain)
+}
+
+// delPortMappings 删除跳转规则和pod的链，链不存在时直接返回
+func (m *iptablesManager) delPortMappings(hostVethName string) error {
+	comment := "ycni: " + hostVethName
+	dnatChain, snatChain := podHostportChains(hostVethName)
+	for _, jump := range []struct {
+		chain, target string
+	}{
+		{ycniHostportsChain, dnatChain},
+		{ycniPostroutingChain, snatChain},
+	} {
+		// 跳转的目标链不存在时跳转规则也不可能存在
+		exists, err := m.chainsExist("nat", jump.chain, jump.target)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err = m.ipt.DeleteIfExists("nat", jump.chain, "-m", "comment", "--comment", comment, "-j", jump.target); err != nil {
+			return iptablesError(err, "删除跳转规则失败: %s", jump.target)
+		}
+	}
+	for _, chain := range []string{dnatChain, snatChain} {
+		if err := m.ipt.ClearAndDeleteChain("nat", chain); err != nil {
+			return iptablesError(err, "删除链nat/%s失败", chain)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitRuleSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want []string
+	}{
+		{
+			name: "plain",
+			rule: "-A YCNI-FORWARD -s 10.244.0.0/24 -j ACCEPT",
+			want: []string{"-A", "YCNI-FORWARD", "-s", "10.244.0.0/24", "-j", "ACCEPT"},
+		},
+		{
+			name: "quoted comment",
+			rule: `-A POSTROUTING -s 10.244.0.0/24 -m comment --comment "ycni masquerade pod traffic" -j MASQUERADE`,
+			want: []string{"-A", "POSTROUTING", "-s", "10.244.0.0/24", "-m", "comment", "--comment", "ycni masquerade pod traffic", "-j", "MASQUERADE"},
+		},
+		{
+			name: "quoted comment at end",
+			rule: `-A YCNI-HOSTPORT -m comment --comment "ycni hostport"`,
+			want: []string{"-A", "YCNI-HOSTPORT", "-m", "comment", "--comment", "ycni hostport"},
+		},
+		{
+			name: "empty quoted field",
+			rule: `-A X --comment "" -j ACCEPT`,
+			want: []string{"-A", "X", "--comment", "", "-j", "ACCEPT"},
+		},
+		{
+			name: "repeated spaces",
+			rule: "  -A  X   -j ACCEPT ",
+			want: []string{"-A", "X", "-j", "ACCEPT"},
+		},
+		{
+			name: "empty",
+			rule: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitRuleSpec(tt.rule); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitRuleSpec(%q) = %q, want %q", tt.rule, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"time"
+	"ycni/log"
+)
+
+const (
+	// pod上指定ip的注解，多个ip用逗号分隔，例如双栈时"10.244.0.10,fd00::10"
+	ycniIPAnnotationKey = "ycni.ip"
+	// 访问apiserver的超时时间，不能让kubelet的ADD一直卡住
+	k8sRequestTimeout = 10 * time.Second
+)
+
+// pod已经被删除，重试也不会成功
+var errPodNotFound = errors.New("pod不存在")
+
+// getPod 获取pod信息，用于读取注解等，没有配置kubeconfig或者不是k8s调用时返回nil。
+// 注解只是覆盖默认配置，apiserver不可用时不能让所有新pod都起不来，记录日志后按没有注解处理。
+// 开启stickyIPs时拿不到pod就认不出statefulset的pod，会分到新的ip，这时让runtime稍后重试
+func getPod(ycniConf *YCNIConfig, cniargs *cniArgs) (*v1.Pod, error) {
+	if ycniConf.Kubeconfig == "" || cniargs.namespace == "" || cniargs.podName == "" {
+		return nil, nil
+	}
+	cfg, err := clientcmd.BuildConfigFromFlags("", ycniConf.Kubeconfig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "加载kubeconfig失败: %s", ycniConf.Kubeconfig)
+	}
+	cfg.Timeout = k8sRequestTimeout
+	clientSet, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "创建clientset失败")
+	}
+	pod, err := clientSet.CoreV1().Pods(cniargs.namespace).Get(context.TODO(), cniargs.podName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(errPodNotFound, "podName: %s, podNameSpace: %s", cniargs.podName, cniargs.namespace)
+	}
+	if err != nil {
+		// 没有权限是配置问题，重试也不会成功
+		if ycniConf.StickyIPs && !apierrors.IsUnauthorized(err) && !apierrors.IsForbidden(err) {
+			return nil, tryAgainError(err, "apiserver不可用", "apiserver is unavailable")
+		}
+		log.Debugf("获取pod信息失败, 忽略pod注解: podName: %s, podNameSpace: %s: %s", cniargs.podName, cniargs.namespace, err.Error())
+		return nil, nil
+	}
+	return pod, nil
+}
+
+// podLookupError pod不存在时返回unknown container，apiserver不可用时保留稍后重试，其他是kubeconfig的配置错误
+func podLookupError(err error) error {
+	if errors.Cause(err) == errPodNotFound {
+		return newCNIError(types.ErrUnknownContainer, err, "pod不存在", "pod not found")
+	}
+	return invalidConfigError(err, "获取pod信息失败", "failed to load kubeconfig")
+}
@@ -13,5 +13,11 @@ const (
 
 func main() {
 	log.InitZapLog(defaultLogFile)
-	skel.PluginMain(cmdAdd, nil, cmdDel, version.All, buildversion.BuildString("ycni"))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    withCNIError("cmdAdd", cmdAdd),
+		Del:    withCNIError("cmdDel", cmdDel),
+		Check:  withCNIError("cmdCheck", cmdCheck),
+		GC:     withCNIError("cmdGC", cmdGC),
+		Status: withCNIError("cmdStatus", cmdStatus),
+	}, version.PluginSupports(supportedVersions...), buildversion.BuildString("ycni"))
 }
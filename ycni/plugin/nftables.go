@@ -0,0 +1,548 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// nftables模式下所有规则都在inet ycni表里，规则只和出口网卡有关，
+// pod的增删只需要增删集合里的元素
+const (
+	nftTableName        = "ycni"
+	nftForwardChain     = "forward"
+	nftPostroutingChain = "postrouting"
+	nftPodIPv4Set       = "pod-ips-v4"
+	nftPodIPv6Set       = "pod-ips-v6"
+	nftHostVethSet      = "host-veths"
+	// 端口映射的规则按pod添加，用规则的userdata记录hostVeth名，ensure时不会清空这几条链
+	nftHostportsChain       = "hostports"
+	nftOutputHostportsChain = "output-hostports"
+	nftHairpinChain         = "hairpin"
+	// conntrack status中的IPS_DST_NAT
+	nftCtStatusDNAT uint32 = 1 << 5
+	// 并发的ADD同时发现基础规则不存在时，只让一个进程创建
+	nftLockFile = "/var/run/ycni/nftables.lock"
+	// 等待nftables锁的超时时间，和iptables -w 5一致
+	nftLockTimeout       = 5 * time.Second
+	nftLockRetryInterval = 100 * time.Millisecond
+)
+
+type nftablesDatapath struct {
+	opts *datapathOptions
+}
+
+type nftObjects struct {
+	table    *nftables.Table
+	podIPv4  *nftables.Set
+	podIPv6  *nftables.Set
+	hostVeth *nftables.Set
+}
+
+func newNFTObjects() *nftObjects {
+	table := &nftables.Table{Name: nftTableName, Family: nftables.TableFamilyINet}
+	return &nftObjects{
+		table:    table,
+		podIPv4:  &nftables.Set{Table: table, Name: nftPodIPv4Set, KeyType: nftables.TypeIPAddr},
+		podIPv6:  &nftables.Set{Table: table, Name: nftPodIPv6Set, KeyType: nftables.TypeIP6Addr},
+		hostVeth: &nftables.Set{Table: table, Name: nftHostVethSet, KeyType: nftables.TypeIFName},
+	}
+}
+
+// baseRulesTag 写在基础规则的userdata里，出口网卡或者nonMasqueradeCIDRs变了才需要重建
+func (d *nftablesDatapath) baseRulesTag() []byte {
+	var cidrs []string
+	for _, cidr := range d.opts.nonMasqCIDRs {
+		cidrs = append(cidrs, cidr.String())
+	}
+	return []byte(fmt.Sprintf("ycni-base out=%s nonmasq=%s", d.opts.outInterface, strings.Join(cidrs, ",")))
+}
+
+// nftTableExists 表不存在说明没有用过nftables datapath，连接失败时按不存在处理
+func nftTableExists() bool {
+	conn, err := nftables.New()
+	if err != nil {
+		return false
+	}
+	_, err = conn.ListTableOfFamily(nftTableName, nftables.TableFamilyINet)
+	return err == nil
+}
+
+// lockNFT 加文件锁，返回解锁函数，超时后让runtime稍后重试
+func lockNFT() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(nftLockFile), 0755); err != nil {
+		return nil, errors.Wrap(err, "创建nftables锁目录失败")
+	}
+	f, err := os.OpenFile(nftLockFile, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "打开nftables锁文件失败")
+	}
+	deadline := time.Now().Add(nftLockTimeout)
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			f.Close()
+			return nil, errors.Wrap(err, "nftables加锁失败")
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, tryAgainError(errors.Wrap(err, "nftables加锁失败"), "等待nftables锁超时", "timed out waiting for the nftables lock")
+		}
+		time.Sleep(nftLockRetryInterval)
+	}
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// ensure 创建表、集合和链，基础规则只在第一次或者配置变化时创建。
+// pod的增删只改集合里的元素，不会动其他pod正在用的转发和masquerade规则
+func (d *nftablesDatapath) ensure(conn *nftables.Conn, objs *nftObjects) error {
+	unlock, err := lockNFT()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conn.AddTable(objs.table)
+	for _, set := range []*nftables.Set{objs.podIPv4, objs.podIPv6, objs.hostVeth} {
+		if err = conn.AddSet(set, nil); err != nil {
+			return errors.Wrapf(err, "创建nftables集合%s失败", set.Name)
+		}
+	}
+
+	accept := nftables.ChainPolicyAccept
+	forward := conn.AddChain(&nftables.Chain{
+		Name:     nftForwardChain,
+		Table:    objs.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &accept,
+	})
+	postrouting := conn.AddChain(&nftables.Chain{
+		Name:     nftPostroutingChain,
+		Table:    objs.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+		Policy:   &accept,
+	})
+	if err = conn.Flush(); err != nil {
+		return errors.Wrap(err, "创建nftables表和链失败")
+	}
+
+	tag := d.baseRulesTag()
+	upToDate := true
+	for _, chain := range []*nftables.Chain{forward, postrouting} {
+		rules, err := conn.GetRules(objs.table, chain)
+		if err != nil {
+			return errors.Wrapf(err, "获取nftables链%s的规则失败", chain.Name)
+		}
+		// 老版本创建的规则没有userdata，也要重建
+		if len(rules) == 0 {
+			upToDate = false
+		}
+		for _, r := range rules {
+			if string(r.UserData) != string(tag) {
+				upToDate = false
+			}
+		}
+	}
+	if upToDate {
+		return nil
+	}
+	// 清空和重建在同一个事务里提交，中间状态不会生效
+	conn.FlushChain(forward)
+	conn.FlushChain(postrouting)
+
+	// iifname @host-veths [oifname <out>] accept
+	conn.AddRule(&nftables.Rule{
+		Table:    objs.table,
+		Chain:    forward,
+		UserData: tag,
+		Exprs: concatExprs(
+			[]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Lookup{SourceRegister: 1, SetName: objs.hostVeth.Name, SetID: objs.hostVeth.ID},
+			},
+			d.ifnameMatch(expr.MetaKeyOIFNAME),
+			[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+		),
+	})
+	// [iifname <out>] oifname @host-veths accept
+	conn.AddRule(&nftables.Rule{
+		Table:    objs.table,
+		Chain:    forward,
+		UserData: tag,
+		Exprs: concatExprs(
+			d.ifnameMatch(expr.MetaKeyIIFNAME),
+			[]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				&expr.Lookup{SourceRegister: 1, SetName: objs.hostVeth.Name, SetID: objs.hostVeth.ID},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		),
+	})
+	// 限制了出口网卡时，其他pod或者pod自己访问hostPort的包不是从出口网卡进来的
+	// oifname @host-veths ct status dnat accept
+	if d.opts.outInterface != "" {
+		conn.AddRule(&nftables.Rule{
+			Table:    objs.table,
+			Chain:    forward,
+			UserData: tag,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				&expr.Lookup{SourceRegister: 1, SetName: objs.hostVeth.Name, SetID: objs.hostVeth.ID},
+				&expr.Ct{Key: expr.CtKeySTATUS, Register: 1},
+				&expr.Bitwise{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Len:            4,
+					Mask:           binaryutil.NativeEndian.PutUint32(nftCtStatusDNAT),
+					Xor:            binaryutil.NativeEndian.PutUint32(0),
+				},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		})
+	}
+	// ip saddr @pod-ips-v4 ip daddr <nonMasq> return
+	// ip saddr @pod-ips-v4 [oifname <out>] masquerade
+	// ipv6同理
+	for _, m := range []struct {
+		proto     byte
+		srcOffset uint32
+		dstOffset uint32
+		len       uint32
+		set       *nftables.Set
+	}{
+		{unix.NFPROTO_IPV4, 12, 16, net.IPv4len, objs.podIPv4},
+		{unix.NFPROTO_IPV6, 8, 24, net.IPv6len, objs.podIPv6},
+	} {
+		srcMatch := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{m.proto}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: m.srcOffset, Len: m.len},
+			&expr.Lookup{SourceRegister: 1, SetName: m.set.Name, SetID: m.set.ID},
+		}
+		for _, cidr := range d.opts.nonMasqCIDRs {
+			ip := cidr.IP.To4()
+			if m.proto == unix.NFPROTO_IPV6 && ip == nil {
+				ip = cidr.IP.To16()
+			}
+			mask := []byte(cidr.Mask)
+			// 只处理和当前地址族一致的网段
+			if uint32(len(ip)) != m.len || len(mask) != len(ip) {
+				continue
+			}
+			conn.AddRule(&nftables.Rule{
+				Table:    objs.table,
+				Chain:    postrouting,
+				UserData: tag,
+				Exprs: concatExprs(srcMatch, []expr.Any{
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: m.dstOffset, Len: m.len},
+					&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: m.len, Mask: mask, Xor: make([]byte, m.len)},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(cidr.Mask)},
+					&expr.Verdict{Kind: expr.VerdictReturn},
+				}),
+			})
+		}
+		conn.AddRule(&nftables.Rule{
+			Table:    objs.table,
+			Chain:    postrouting,
+			UserData: tag,
+			Exprs:    concatExprs(srcMatch, d.ifnameMatch(expr.MetaKeyOIFNAME), []expr.Any{&expr.Masq{}}),
+		})
+	}
+	if err = conn.Flush(); err != nil {
+		return errors.Wrap(err, "提交nftables基础规则失败")
+	}
+	return nil
+}
+
+// ifnameMatch 匹配出口网卡，没有指定出口网卡时不匹配
+func (d *nftablesDatapath) ifnameMatch(key expr.MetaKey) []expr.Any {
+	if d.opts.outInterface == "" {
+		return nil
+	}
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftIfname(d.opts.outInterface)},
+	}
+}
+
+func concatExprs(parts ...[]expr.Any) []expr.Any {
+	var exprs []expr.Any
+	for _, p := range parts {
+		exprs = append(exprs, p...)
+	}
+	return exprs
+}
+
+func (d *nftablesDatapath) setupPod(hostVethName string, podIPs []net.IPNet) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return errors.Wrap(err, "连接nftables失败")
+	}
+	objs := newNFTObjects()
+	if err = d.ensure(conn, objs); err != nil {
+		return err
+	}
+	if err = conn.SetAddElements(objs.hostVeth, []nftables.SetElement{{Key: nftIfname(hostVethName)}}); err != nil {
+		return errors.Wrapf(err, "添加hostVeth到nftables集合失败: %s", hostVethName)
+	}
+	for _, ipNet := range podIPs {
+		set, key := objs.podIPSet(ipNet.IP)
+		if err = conn.SetAddElements(set, []nftables.SetElement{{Key: key}}); err != nil {
+			return errors.Wrapf(err, "添加pod ip到nftables集合失败: %s", ipNet.IP)
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return errors.Wrap(err, "提交nftables规则失败")
+	}
+	return nil
+}
+
+func (d *nftablesDatapath) teardownPod(hostVethName string, podIPs []net.IPNet) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return errors.Wrap(err, "连接nftables失败")
+	}
+	objs := newNFTObjects()
+	if _, err = conn.ListTableOfFamily(nftTableName, nftables.TableFamilyINet); err != nil {
+		// 表不存在说明没有需要删除的元素
+		return nil
+	}
+
+	remove := map[*nftables.Set][][]byte{
+		objs.hostVeth: {nftIfname(hostVethName)},
+	}
+	for _, ipNet := range podIPs {
+		set, key := objs.podIPSet(ipNet.IP)
+		remove[set] = append(remove[set], key)
+	}
+	// 删除不存在的元素会让整个事务失败，所以只删集合里现有的
+	for set, keys := range remove {
+		elems, err := conn.GetSetElements(set)
+		if err != nil {
+			return errors.Wrapf(err, "获取nftables集合%s失败", set.Name)
+		}
+		var del []nftables.SetElement
+		for _, key := range keys {
+			for _, e := range elems {
+				if string(e.Key) == string(key) {
+					del = append(del, nftables.SetElement{Key: key})
+					break
+				}
+			}
+		}
+		if len(del) == 0 {
+			continue
+		}
+		if err = conn.SetDeleteElements(set, del); err != nil {
+			return errors.Wrapf(err, "删除nftables集合%s元素失败", set.Name)
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return errors.Wrap(err, "提交nftables规则失败")
+	}
+	return nil
+}
+
+func (o *nftObjects) podIPSet(ip net.IP) (*nftables.Set, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return o.podIPv4, ip4
+	}
+	return o.podIPv6, ip.To16()
+}
+
+// nftIfname 网卡名在nftables里是定长16字节，不足补0
+func nftIfname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// hostportChains 端口映射用的三条链，dnat分别挂在prerouting和output上，pod访问自己hostPort的snat挂在postrouting上，
+// 优先级比postrouting链高，先于子网的return规则执行
+func (o *nftObjects) hostportChains() []*nftables.Chain {
+	accept := nftables.ChainPolicyAccept
+	return []*nftables.Chain{
+		{
+			Name:     nftHostportsChain,
+			Table:    o.table,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityNATDest,
+			Policy:   &accept,
+		},
+		{
+			Name:     nftOutputHostportsChain,
+			Table:    o.table,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookOutput,
+			Priority: nftables.ChainPriorityNATDest,
+			Policy:   &accept,
+		},
+		{
+			Name:     nftHairpinChain,
+			Table:    o.table,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookPostrouting,
+			Priority: nftables.ChainPriorityRef(*nftables.ChainPriorityNATSource - 1),
+			Policy:   &accept,
+		},
+	}
+}
+
+func (d *nftablesDatapath) setupPortMappings(hostVethName string, podIPs []net.IPNet, mappings []hostportMapping) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return errors.Wrap(err, "连接nftables失败")
+	}
+	objs := newNFTObjects()
+	if err = d.ensure(conn, objs); err != nil {
+		return err
+	}
+	chains := objs.hostportChains()
+	for _, chain := range chains {
+		conn.AddChain(chain)
+	}
+	if err = conn.Flush(); err != nil {
+		return errors.Wrap(err, "创建nftables链失败")
+	}
+	// 重复ADD时先删掉pod原来的规则
+	if err = d.delPortMappingRules(conn, objs, hostVethName); err != nil {
+		return err
+	}
+
+	userData := []byte(hostVethName)
+	for _, podIP := range podIPs {
+		nfproto, daddrOffset, saddrOffset := byte(unix.NFPROTO_IPV4), uint32(16), uint32(12)
+		addr := podIP.IP.To4()
+		if addr == nil {
+			nfproto, daddrOffset, saddrOffset = unix.NFPROTO_IPV6, 24, 8
+			addr = podIP.IP.To16()
+		}
+		for _, pm := range mappings {
+			if !pm.matchFamily(podIP.IP) {
+				continue
+			}
+			// fib daddr type local [ip daddr <hostIP>] <proto> dport <hostPort> dnat to <podIP>:<containerPort>
+			match := []expr.Any{
+				&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+			}
+			if pm.hostIP != nil {
+				hostIP := pm.hostIP.To4()
+				if hostIP == nil {
+					hostIP = pm.hostIP.To16()
+				}
+				match = append(match,
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: daddrOffset, Len: uint32(len(hostIP))},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: hostIP},
+				)
+			}
+			dnat := concatExprs(match, l4PortMatch(pm.l4proto(), pm.hostPort), []expr.Any{
+				&expr.Immediate{Register: 1, Data: addr},
+				&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(pm.containerPort)},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: uint32(nfproto), RegAddrMin: 1, RegProtoMin: 2},
+			})
+			for _, chain := range chains[:2] {
+				conn.AddRule(&nftables.Rule{Table: objs.table, Chain: chain, Exprs: dnat, UserData: userData})
+			}
+			// pod访问自己的hostPort时，dnat后源和目的都是自己，要snat成宿主机的地址回包才会经过宿主机
+			// ip saddr <podIP> ip daddr <podIP> <proto> dport <containerPort> masquerade
+			conn.AddRule(&nftables.Rule{
+				Table: objs.table,
+				Chain: chains[2],
+				Exprs: concatExprs([]expr.Any{
+					&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: saddrOffset, Len: uint32(len(addr))},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: daddrOffset, Len: uint32(len(addr))},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+				}, l4PortMatch(pm.l4proto(), pm.containerPort), []expr.Any{&expr.Masq{}}),
+				UserData: userData,
+			})
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return errors.Wrap(err, "提交nftables规则失败")
+	}
+	return nil
+}
+
+// l4PortMatch meta l4proto <proto> th dport <port>
+func l4PortMatch(l4proto byte, port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	}
+}
+
+func (d *nftablesDatapath) teardownPortMappings(hostVethName string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return errors.Wrap(err, "连接nftables失败")
+	}
+	if err = d.delPortMappingRules(conn, newNFTObjects(), hostVethName); err != nil {
+		return err
+	}
+	if err = conn.Flush(); err != nil {
+		return errors.Wrap(err, "提交nftables规则失败")
+	}
+	return nil
+}
+
+// delPortMappingRules 删除userdata是hostVeth名的规则，只加到conn里不提交，表或链不存在时跳过
+func (d *nftablesDatapath) delPortMappingRules(conn *nftables.Conn, objs *nftObjects, hostVethName string) error {
+	existing, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return errors.Wrap(err, "获取nftables链失败")
+	}
+	for _, chain := range objs.hostportChains() {
+		found := false
+		for _, c := range existing {
+			if c.Table.Name == nftTableName && c.Name == chain.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		rules, err := conn.GetRules(objs.table, chain)
+		if err != nil {
+			return errors.Wrapf(err, "获取nftables链%s的规则失败", chain.Name)
+		}
+		for _, r := range rules {
+			if string(r.UserData) != hostVethName {
+				continue
+			}
+			r.Table, r.Chain = objs.table, chain
+			if err = conn.DelRule(r); err != nil {
+				return errors.Wrapf(err, "删除nftables规则失败: %s", chain.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"ycni/log"
+)
+
+type undoFunc struct {
+	desc string
+	fn   func() error
+}
+
+// rollback 记录cmdAdd中已经完成的步骤，失败时按相反顺序撤销
+type rollback struct {
+	undos []undoFunc
+}
+
+func (r *rollback) add(desc string, fn func() error) {
+	r.undos = append(r.undos, undoFunc{desc: desc, fn: fn})
+}
+
+func (r *rollback) run() {
+	for i := len(r.undos) - 1; i >= 0; i-- {
+		u := r.undos[i]
+		log.Debugf("rollback: %s", u.desc)
+		if err := u.fn(); err != nil {
+			// 回滚失败只记录日志，继续回滚剩下的步骤
+			log.Debugf("rollback %s失败: %s", u.desc, err.Error())
+		}
+	}
+	r.undos = nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+	"net"
+	"strings"
+)
+
+// pod上覆盖路由的注解，格式和配置中的routes一样，例如[{"dst":"10.0.0.0/8"},{"dst":"192.168.0.0/16","gw":"10.1.0.1"}]
+const ycniRoutesAnnotationKey = "ycni.routes"
+
+// podRoutes 返回要在容器内添加的路由，优先级: CNI_ARGS中的ROUTES > pod注解 > 配置中的routes > 默认路由，
+// CNI_ARGS中的ROUTES是逗号分隔的网段，都走pod的默认网关
+func podRoutes(ycniConf *YCNIConfig, cniargs *cniArgs, pod *v1.Pod) ([]*types.Route, error) {
+	switch {
+	case cniargs.routes != "":
+		var routes []*types.Route
+		for _, dst := range strings.Split(cniargs.routes, ",") {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(dst))
+			if err != nil {
+				return nil, errors.Wrapf(err, "解析CNI_ARGS中的ROUTES失败: %s", dst)
+			}
+			routes = append(routes, &types.Route{Dst: *ipNet})
+		}
+		return routes, nil
+	case pod != nil && pod.Annotations[ycniRoutesAnnotationKey] != "":
+		var routes []*types.Route
+		if err := json.Unmarshal([]byte(pod.Annotations[ycniRoutesAnnotationKey]), &routes); err != nil {
+			return nil, errors.Wrapf(err, "解析pod注解%s失败", ycniRoutesAnnotationKey)
+		}
+		return routes, nil
+	case len(ycniConf.Routes) > 0:
+		return ycniConf.Routes, nil
+	}
+	routes := make([]*types.Route, 0, len(defaultRoutes))
+	for _, r := range defaultRoutes {
+		routes = append(routes, &types.Route{Dst: *r})
+	}
+	return routes, nil
+}
+
+// familyRoutes 只保留pod有对应地址族的路由，没有指定网关的填上pod的默认网关，结果里也用这份路由
+func familyRoutes(routes []*types.Route, gws podGateways) []*types.Route {
+	var filtered []*types.Route
+	for _, r := range routes {
+		gw := gws.v4
+		if r.Dst.IP.To4() == nil {
+			gw = gws.v6
+		}
+		if gw == nil {
+			continue
+		}
+		route := r.Copy()
+		if route.GW == nil {
+			route.GW = gw
+		}
+		filtered = append(filtered, route)
+	}
+	return filtered
+}
+
+// addPodRoute 需要在容器ns中调用，经过pod默认网关的路由从容器内的veth出去，
+// 其他网关由内核按路由查找出口网卡，例如conflist中前面插件配置的第二块网卡
+func addPodRoute(nsVeth netlink.Link, r *types.Route, gws podGateways) error {
+	route := &netlink.Route{Dst: &r.Dst, Gw: r.GW}
+	if gws.contains(r.GW) {
+		route.LinkIndex = nsVeth.Attrs().Index
+	}
+	if err := netlink.RouteAdd(route); err != nil {
+		return errors.Wrapf(err, "容器内添加路由失败: %s via %s", r.Dst.String(), r.GW)
+	}
+	return nil
+}
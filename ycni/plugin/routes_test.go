@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustRoute(t *testing.T, dst, gw string) *types.Route {
+	t.Helper()
+	_, ipNet, err := net.ParseCIDR(dst)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%s): %v", dst, err)
+	}
+	return &types.Route{Dst: *ipNet, GW: net.ParseIP(gw)}
+}
+
+func routeStrings(routes []*types.Route) []string {
+	var out []string
+	for _, r := range routes {
+		if r.GW == nil {
+			out = append(out, r.Dst.String())
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s via %s", r.Dst.String(), r.GW))
+	}
+	return out
+}
+
+func podWithAnnotation(value string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pod",
+		Namespace:   "default",
+		Annotations: map[string]string{ycniRoutesAnnotationKey: value},
+	}}
+}
+
+func TestPodRoutes(t *testing.T) {
+	confRoutes := []*types.Route{mustRoute(t, "10.0.0.0/8", ""), mustRoute(t, "192.168.0.0/16", "10.1.0.1")}
+	tests := []struct {
+		name       string
+		confRoutes []*types.Route
+		args       string
+		pod        *v1.Pod
+		want       []string
+		wantErr    bool
+	}{
+		{
+			name: "default",
+			want: []string{"0.0.0.0/0", "::/0"},
+		},
+		{
+			name: "pod without annotation",
+			pod:  &v1.Pod{},
+			want: []string{"0.0.0.0/0", "::/0"},
+		},
+		{
+			name:       "config",
+			confRoutes: confRoutes,
+			want:       []string{"10.0.0.0/8", "192.168.0.0/16 via 10.1.0.1"},
+		},
+		{
+			name:       "annotation over config",
+			confRoutes: confRoutes,
+			pod:        podWithAnnotation(`[{"dst":"172.16.0.0/12"},{"dst":"fd00::/8","gw":"fd01::1"}]`),
+			want:       []string{"172.16.0.0/12", "fd00::/8 via fd01::1"},
+		},
+		{
+			name:       "cni args over annotation",
+			confRoutes: confRoutes,
+			args:       "K8s_POD_NAME=pod;ROUTES=100.64.0.0/10, fd00::/8",
+			pod:        podWithAnnotation(`[{"dst":"172.16.0.0/12"}]`),
+			want:       []string{"100.64.0.0/10", "fd00::/8"},
+		},
+		{
+			name:    "invalid cni args",
+			args:    "ROUTES=100.64.0.0/33",
+			wantErr: true,
+		},
+		{
+			name:    "invalid annotation",
+			pod:     podWithAnnotation(`{"dst":"172.16.0.0/12"}`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &YCNIConfig{Routes: tt.confRoutes}
+			routes, err := podRoutes(conf, parseArgs(tt.args), tt.pod)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("podRoutes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := routeStrings(routes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podRoutes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFamilyRoutes(t *testing.T) {
+	routes := []*types.Route{
+		mustRoute(t, "0.0.0.0/0", ""),
+		mustRoute(t, "::/0", ""),
+		mustRoute(t, "192.168.0.0/16", "10.1.0.1"),
+		mustRoute(t, "fd00::/8", "fd01::1"),
+	}
+	tests := []struct {
+		name string
+		gws  podGateways
+		want []string
+	}{
+		{
+			name: "dual stack",
+			gws:  routedGateways(true, true),
+			want: []string{"0.0.0.0/0 via 169.254.1.1", "::/0 via fe80::1", "192.168.0.0/16 via 10.1.0.1", "fd00::/8 via fd01::1"},
+		},
+		{
+			name: "ipv4 only",
+			gws:  routedGateways(true, false),
+			want: []string{"0.0.0.0/0 via 169.254.1.1", "192.168.0.0/16 via 10.1.0.1"},
+		},
+		{
+			name: "ipv6 only",
+			gws:  routedGateways(false, true),
+			want: []string{"::/0 via fe80::1", "fd00::/8 via fd01::1"},
+		},
+		{
+			name: "bridge gateway",
+			gws:  podGateways{v4: net.ParseIP("10.244.0.1")},
+			want: []string{"0.0.0.0/0 via 10.244.0.1", "192.168.0.0/16 via 10.1.0.1"},
+		},
+		{
+			name: "no address",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routeStrings(familyRoutes(routes, tt.gws)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("familyRoutes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// 填网关时不能改到传入的路由
+	if routes[0].GW != nil || routes[1].GW != nil {
+		t.Errorf("familyRoutes()修改了传入的路由: %v", routeStrings(routes))
+	}
+}
+
+func TestIPAMArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{args: "", want: ""},
+		{args: "IgnoreUnknown=1;K8s_POD_NAME=pod", want: "IgnoreUnknown=1;K8s_POD_NAME=pod"},
+		{args: "K8s_POD_NAME=pod;ROUTES=10.0.0.0/8,fd00::/8;IP=10.244.0.5", want: "K8s_POD_NAME=pod"},
+		{args: "IgnoreUnknown=1;IP=10.244.0.5", want: "IgnoreUnknown=1"},
+		{args: "ROUTES=10.0.0.0/8", want: ""},
+		{args: ";K8s_POD_NAME=pod;;", want: "K8s_POD_NAME=pod"},
+	}
+	for _, tt := range tests {
+		if got := ipamArgs(tt.args); got != tt.want {
+			t.Errorf("ipamArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+	"ycni/log"
+)
+
+// 默认pod网卡是veth。ipvlan和macvlan的pod网卡直接建在父设备上，少了一次veth转发，
+// 但宿主机访问不到父设备上的子接口，所以在宿主机上再建一个同类型的shim子接口，
+// shim上配置pod的网关169.254.1.1和fe80::1，宿主机到pod的路由走shim，pod的ip、网关和路由和veth时一样
+const (
+	ifTypeVeth    = "veth"
+	ifTypeIPVlan  = "ipvlan"
+	ifTypeMacvlan = "macvlan"
+
+	// l3s经过宿主机的netfilter，kube-proxy的service规则对pod才生效
+	ipvlanModeL3  = "l3"
+	ipvlanModeL3S = "l3s"
+
+	defaultShimName = "ycnishim0"
+)
+
+func (c *YCNIConfig) interfaceType() string {
+	if c.InterfaceType == "" {
+		return ifTypeVeth
+	}
+	return c.InterfaceType
+}
+
+// shimMode pod网卡不是veth，宿主机通过shim访问pod
+func (c *YCNIConfig) shimMode() bool {
+	return c.interfaceType() != ifTypeVeth
+}
+
+func (c *YCNIConfig) shimName() string {
+	if c.Shim != "" {
+		return c.Shim
+	}
+	return defaultShimName
+}
+
+// validateInterfaceType 网桥模式只能用veth
+func validateInterfaceType(ycniConf *YCNIConfig) error {
+	switch ycniConf.interfaceType() {
+	case ifTypeVeth, ifTypeIPVlan, ifTypeMacvlan:
+	default:
+		return errors.Errorf("不支持的网卡类型: %s", ycniConf.InterfaceType)
+	}
+	switch ycniConf.IPVlanMode {
+	case "", ipvlanModeL3, ipvlanModeL3S:
+	default:
+		return errors.Errorf("不支持的ipvlan模式: %s", ycniConf.IPVlanMode)
+	}
+	if ycniConf.shimMode() && ycniConf.bridgeMode() {
+		return errors.Errorf("网桥模式不支持%s", ycniConf.InterfaceType)
+	}
+	return nil
+}
+
+// masterLink pod网卡的父设备，没有配置时使用出口网卡
+func masterLink(ycniConf *YCNIConfig) (netlink.Link, error) {
+	name := ycniConf.Master
+	if name == "" {
+		name = ycniConf.OutInterface
+	}
+	if name == "" {
+		gateway, err := getDefaultGatewayInterface()
+		if err != nil {
+			return nil, errors.Wrap(err, "获取路由出口网卡失败")
+		}
+		name = gateway.Name
+	}
+	master, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "没有找到父设备: %s", name)
+	}
+	return master, nil
+}
+
+// newSubLink pod网卡和shim用同样的类型和模式，ipvlan同一个父设备上只能有一种模式
+func newSubLink(ycniConf *YCNIConfig, master netlink.Link, name string, mtu int) netlink.Link {
+	attrs := netlink.LinkAttrs{Name: name, MTU: mtu, ParentIndex: master.Attrs().Index}
+	if ycniConf.interfaceType() == ifTypeMacvlan {
+		return &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	}
+	mode := netlink.IPVLAN_MODE_L3
+	if ycniConf.IPVlanMode == ipvlanModeL3S {
+		mode = netlink.IPVLAN_MODE_L3S
+	}
+	return &netlink.IPVlan{LinkAttrs: attrs, Mode: mode}
+}
+
+// addPodLink 在宿主机上用临时名字创建pod网卡再放到容器ns中，避免和宿主机上的网卡重名，
+// 进入容器ns后再改成ifName
+func addPodLink(ycniConf *YCNIConfig, tmpName, netnsPath string, mtu int) error {
+	master, err := masterLink(ycniConf)
+	if err != nil {
+		return err
+	}
+	netNS, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return errors.Wrapf(err, "打开ns失败: %s", netnsPath)
+	}
+	defer netNS.Close()
+
+	if err = netlink.LinkAdd(newSubLink(ycniConf, master, tmpName, mtu)); err != nil {
+		return errors.Wrapf(err, "创建%s失败: %s", ycniConf.interfaceType(), tmpName)
+	}
+	link, err := netlink.LinkByName(tmpName)
+	if err != nil {
+		return errors.Wrapf(err, "没找到对应的%s: %s", ycniConf.interfaceType(), tmpName)
+	}
+	if err = netlink.LinkSetNsFd(link, int(netNS.Fd())); err != nil {
+		_ = netlink.LinkDel(link)
+		return errors.Wrapf(err, "把%s放到容器ns失败", tmpName)
+	}
+	return nil
+}
+
+// ensureShim shim不存在时在父设备上创建，配置pod的网关地址并up。
+// pod的arp和ndp请求由shim应答，宿主机访问pod时源地址也是网关地址，pod的回包经过shim回到宿主机
+func ensureShim(ycniConf *YCNIConfig, mtu int, hasIpv4, hasIpv6 bool) (netlink.Link, error) {
+	master, err := masterLink(ycniConf)
+	if err != nil {
+		return nil, err
+	}
+	name := ycniConf.shimName()
+	shim, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, errors.Wrapf(err, "获取shim失败: %s", name)
+		}
+		err = netlink.LinkAdd(newSubLink(ycniConf, master, name, mtu))
+		// 并发的ADD可能已经建好了
+		if err != nil && err != syscall.EEXIST {
+			return nil, errors.Wrapf(err, "创建shim失败: %s", name)
+		}
+		if shim, err = netlink.LinkByName(name); err != nil {
+			return nil, errors.Wrapf(err, "获取shim失败: %s", name)
+		}
+	}
+	if shim.Type() != ycniConf.interfaceType() {
+		return nil, errors.Errorf("%s不是%s: %s", name, ycniConf.interfaceType(), shim.Type())
+	}
+	if shim.Attrs().ParentIndex != master.Attrs().Index {
+		return nil, errors.Errorf("shim %s的父设备不是%s", name, master.Attrs().Name)
+	}
+
+	addrs, err := netlink.AddrList(shim, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "获取shim地址失败: %s", name)
+	}
+	var gateways []*net.IPNet
+	if hasIpv4 {
+		gateways = append(gateways, defaultGwIPNet)
+	}
+	if hasIpv6 {
+		gateways = append(gateways, defaultGwIPNet6)
+	}
+	for _, gw := range gateways {
+		if hasAddr(addrs, gw) {
+			continue
+		}
+		addr := &netlink.Addr{IPNet: gw}
+		if gw.IP.To4() == nil {
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err = netlink.AddrAdd(shim, addr); err != nil && err != syscall.EEXIST {
+			return nil, errors.Wrapf(err, "shim配置地址失败: %s", gw.String())
+		}
+	}
+	if err = netlink.LinkSetUp(shim); err != nil {
+		return nil, errors.Wrapf(err, "shim up失败: %s", name)
+	}
+	return shim, nil
+}
+
+// delShimRoutes 删除宿主机上经过shim到pod的路由，shim或路由已经不在时不报错
+func delShimRoutes(ycniConf *YCNIConfig, podIPs []net.IPNet) error {
+	shim, err := netlink.LinkByName(ycniConf.shimName())
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return errors.Wrapf(err, "获取shim失败: %s", ycniConf.shimName())
+	}
+	for i := range podIPs {
+		err = netlink.RouteDel(&netlink.Route{
+			LinkIndex: shim.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       &podIPs[i],
+		})
+		if err != nil && err != syscall.ESRCH {
+			return errors.Wrapf(err, "删除到pod的路由失败: %s", podIPs[i].String())
+		}
+	}
+	return nil
+}
+
+// checkShim 检查shim是否up，以及宿主机上经过shim到pod的路由
+func checkShim(ycniConf *YCNIConfig, podIPs []net.IPNet) error {
+	name := ycniConf.shimName()
+	shim, err := netlink.LinkByName(name)
+	if err != nil {
+		return driftError(err, fmt.Sprintf("没有找到shim: %s", name), "host shim interface not found")
+	}
+	if shim.Attrs().Flags&net.FlagUp == 0 {
+		return driftError(cniDetail(name), "shim未up", "host shim interface is down")
+	}
+	routes, err := netlink.RouteList(shim, netlink.FAMILY_ALL)
+	if err != nil {
+		return internalError(err, "获取宿主机路由失败", "failed to list host routes")
+	}
+	for _, podIP := range podIPs {
+		dst := podIP.String()
+		if !hasRoute(routes, func(r netlink.Route) bool {
+			return r.Dst != nil && r.Dst.String() == dst
+		}) {
+			log.Debugf("shim上缺少到pod的路由: %s", dst)
+			return driftError(cniDetail(dst), "宿主机缺少到容器的路由", "host is missing the route to the pod")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"net"
+	"os"
+	"path/filepath"
+	"ycni/log"
+)
+
+// statefulset的pod按namespace/podName保留ip，pod重建后拿回原来的ip。
+// 保留记录由插件在ADD成功后写入，DEL时不删除，
+// 由ycnid在statefulset或pvc被删除后清理，两边的文件格式需要保持一致
+const defaultStickyDir = "/var/lib/cni/ycni/sticky"
+
+type stickyReservation struct {
+	Namespace   string `json:"namespace"`
+	PodName     string `json:"podName"`
+	StatefulSet string `json:"statefulSet"`
+	// 用uid区分同名重建的statefulset
+	StatefulSetUID string   `json:"statefulSetUID"`
+	PVCs           []string `json:"pvcs,omitempty"`
+	IPs            []string `json:"ips"`
+}
+
+// stickyDir 每个网络一个目录，和host-local的存储目录一样按网络名区分
+func stickyDir(ycniConf *YCNIConfig) string {
+	return filepath.Join(defaultStickyDir, ycniConf.Name)
+}
+
+func stickyFile(ycniConf *YCNIConfig, namespace, podName string) string {
+	return filepath.Join(stickyDir(ycniConf), namespace+"_"+podName+".json")
+}
+
+// stickyOwner 返回pod所属的statefulset，不是statefulset的pod不保留ip
+func stickyOwner(ycniConf *YCNIConfig, pod *v1.Pod) *stickyReservation {
+	if !ycniConf.StickyIPs || pod == nil {
+		return nil
+	}
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind != "StatefulSet" || ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+		r := &stickyReservation{
+			Namespace:      pod.Namespace,
+			PodName:        pod.Name,
+			StatefulSet:    ref.Name,
+			StatefulSetUID: string(ref.UID),
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil {
+				r.PVCs = append(r.PVCs, vol.PersistentVolumeClaim.ClaimName)
+			}
+		}
+		return r
+	}
+	return nil
+}
+
+// loadStickyReservations 读取当前网络所有的保留记录，目录不存在时返回空
+func loadStickyReservations(ycniConf *YCNIConfig) ([]*stickyReservation, error) {
+	files, err := filepath.Glob(filepath.Join(stickyDir(ycniConf), "*.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "读取ip保留记录失败")
+	}
+	var reservations []*stickyReservation
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			// 可能刚被ycnid清理掉
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "读取ip保留记录失败: %s", file)
+		}
+		r := &stickyReservation{}
+		if err = json.Unmarshal(data, r); err != nil {
+			log.Debugf("ip保留记录格式错误, 忽略: %s: %s", file, err.Error())
+			continue
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+// stickyIPs 返回pod自己保留的ip和其他pod保留的ip，其他pod保留的ip不能再分配出去
+func stickyIPs(ycniConf *YCNIConfig, owner *stickyReservation) (own []*ip.IP, others []string, err error) {
+	if !ycniConf.StickyIPs {
+		return nil, nil, nil
+	}
+	reservations, err := loadStickyReservations(ycniConf)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, r := range reservations {
+		if owner == nil || r.Namespace != owner.Namespace || r.PodName != owner.PodName {
+			others = append(others, r.IPs...)
+			continue
+		}
+		for _, s := range r.IPs {
+			if addr := ip.ParseIP(s); addr != nil {
+				own = append(own, addr)
+			}
+		}
+	}
+	return own, others, nil
+}
+
+// reservedByOthers 返回指定的ip中已经保留给其他pod的ip，没有时返回nil。
+// 这些ip会加到exclude里，不先检查的话报错是不在本节点可分配的范围内，不好排查
+func reservedByOthers(requested []*ip.IP, others []string) net.IP {
+	reserved := make(map[string]bool, len(others))
+	for _, s := range others {
+		if addr := net.ParseIP(s); addr != nil {
+			reserved[addr.String()] = true
+		}
+	}
+	for _, r := range requested {
+		if addr := r.ToIP(); reserved[addr.String()] {
+			return addr
+		}
+	}
+	return nil
+}
+
+// saveStickyReservation 记录pod分配到的ip，先写临时文件再rename，避免读到写了一半的文件
+func saveStickyReservation(ycniConf *YCNIConfig, owner *stickyReservation, result *types100.Result) error {
+	r := *owner
+	r.IPs = nil
+	for _, ipc := range result.IPs {
+		r.IPs = append(r.IPs, ipc.Address.IP.String())
+	}
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return errors.Wrap(err, "序列化ip保留记录失败")
+	}
+	if err = os.MkdirAll(stickyDir(ycniConf), 0755); err != nil {
+		return errors.Wrap(err, "创建ip保留记录目录失败")
+	}
+	file := stickyFile(ycniConf, r.Namespace, r.PodName)
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrapf(err, "写入ip保留记录失败: %s", tmp)
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		return errors.Wrapf(err, "写入ip保留记录失败: %s", file)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/containernetworking/plugins/pkg/ip"
+	"testing"
+)
+
+func TestReservedByOthers(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		others    []string
+		want      string
+	}{
+		{name: "nothing requested", others: []string{"10.0.0.5"}},
+		{name: "not reserved", requested: []string{"10.0.0.6"}, others: []string{"10.0.0.5"}},
+		{name: "reserved", requested: []string{"10.0.0.6", "10.0.0.5"}, others: []string{"10.0.0.5"}, want: "10.0.0.5"},
+		{name: "ipv6 reserved", requested: []string{"fd00::0005"}, others: []string{"fd00::5"}, want: "fd00::5"},
+		{name: "invalid reservation ignored", requested: []string{"10.0.0.5"}, others: []string{"foo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested []*ip.IP
+			for _, s := range tt.requested {
+				requested = append(requested, ip.ParseIP(s))
+			}
+			got := ""
+			if addr := reservedByOthers(requested, tt.others); addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("reservedByOthers(%v, %v) = %q, want %q", tt.requested, tt.others, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pod上设置容器内sysctl的注解，例如{"net.core.somaxconn":"1024"}，只能设置白名单里的
+const ycniSysctlsAnnotationKey = "ycni.sysctls"
+
+// defaultAllowedSysctls 注解可以设置的sysctl，都是只影响pod自己网络命名空间的，
+// 和kubernetes的safe sysctls一致
+var defaultAllowedSysctls = []string{
+	"net.core.somaxconn",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.ip_local_reserved_ports",
+	"net.ipv4.ip_unprivileged_port_start",
+	"net.ipv4.ping_group_range",
+	"net.ipv4.tcp_syncookies",
+	"net.ipv4.tcp_keepalive_time",
+	"net.ipv4.tcp_keepalive_intvl",
+	"net.ipv4.tcp_keepalive_probes",
+	"net.ipv4.tcp_fin_timeout",
+	"net.ipv4.tcp_rmem",
+	"net.ipv4.tcp_wmem",
+}
+
+// podSysctls 返回要在容器内设置的sysctl，配置中的是管理员给的不受白名单限制，注解中的覆盖配置中的
+func podSysctls(ycniConf *YCNIConfig, pod *v1.Pod) (map[string]string, error) {
+	sysctls := map[string]string{}
+	for key, value := range ycniConf.Sysctls {
+		if err := validateSysctlKey(key); err != nil {
+			return nil, err
+		}
+		sysctls[key] = value
+	}
+	if pod == nil || pod.Annotations[ycniSysctlsAnnotationKey] == "" {
+		return sysctls, nil
+	}
+	var annotated map[string]string
+	if err := json.Unmarshal([]byte(pod.Annotations[ycniSysctlsAnnotationKey]), &annotated); err != nil {
+		return nil, errors.Wrapf(err, "解析pod注解%s失败", ycniSysctlsAnnotationKey)
+	}
+	allowed := ycniConf.AllowedSysctls
+	if allowed == nil {
+		allowed = defaultAllowedSysctls
+	}
+	for key, value := range annotated {
+		if err := validateSysctlKey(key); err != nil {
+			return nil, err
+		}
+		if !sysctlAllowed(key, allowed) {
+			return nil, errors.Errorf("sysctl不在白名单中: %s", key)
+		}
+		sysctls[key] = value
+	}
+	return sysctls, nil
+}
+
+// sysctlAllowed 白名单中以*结尾的表示前缀，例如net.ipv4.tcp_*
+func sysctlAllowed(key string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == key || (strings.HasSuffix(a, "*") && strings.HasPrefix(key, strings.TrimSuffix(a, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSysctlKey 只有net.开头的sysctl属于网络命名空间，其他的会改到宿主机
+func validateSysctlKey(key string) error {
+	path := sysctlPath(key)
+	if !strings.HasPrefix(path, "/proc/sys/net/") || strings.Contains(key, "..") {
+		return errors.Errorf("只能设置net.开头的sysctl: %s", key)
+	}
+	return nil
+}
+
+// sysctlPath 和sysctl命令一样，key中有/时按路径处理，网卡名里的点就不会被当成分隔符，例如net/ipv4/conf/eth0.100/rp_filter
+func sysctlPath(key string) string {
+	if strings.Contains(key, "/") {
+		return filepath.Join("/proc/sys", key)
+	}
+	return filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+}
+
+// applySysctls 需要在容器ns中调用，按key排序设置，出错时能知道是哪一个
+func applySysctls(sysctls map[string]string) error {
+	keys := make([]string, 0, len(sysctls))
+	for key := range sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := writeProcSys(sysctlPath(key), sysctls[key]); err != nil {
+			return errors.Wrapf(err, "设置sysctl失败: %s=%s", key, sysctls[key])
+		}
+	}
+	return nil
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
 	"fmt"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
 	"io"
+	"net"
 	"os"
-	"os/exec"
 	"strings"
 )
 
@@ -25,18 +25,69 @@ func writeProcSys(path, value string) error {
 	return err
 }
 
-func vethNameForWorkload(namespace, podname string) string {
-	// A SHA1 is always 20 bytes long, and so is sufficient for generating the
-	// veth name and mac addr.
-	//namespace = fmt.Sprintf("%s/%d", namespace, rand.Int())
-	//podname = fmt.Sprintf("%s/%d", podname, rand.Int())
-	h := sha1.New()
-	h.Write([]byte(fmt.Sprintf("%s.%s", namespace, podname)))
-	return fmt.Sprintf("%s%s", "veth", hex.EncodeToString(h.Sum(nil))[:11])
+func readProcSys(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
 }
 
-func Exec(cmd string, args ...string) error {
-	return exec.Command(cmd, args...).Run()
+// setupProxyNDP 让宿主机veth替容器的ipv6网关应答邻居请求，相当于ipv4的proxy_arp
+func setupProxyNDP(hostVeth netlink.Link) error {
+	name := hostVeth.Attrs().Name
+	if err := writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/proxy_ndp", name), "1"); err != nil {
+		return err
+	}
+	// 内核只在开启转发的网卡上做ndp代理
+	if err := writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/forwarding", name), "1"); err != nil {
+		return err
+	}
+	return netlink.NeighSet(&netlink.Neigh{
+		LinkIndex: hostVeth.Attrs().Index,
+		Family:    netlink.FAMILY_V6,
+		Flags:     netlink.NTF_PROXY,
+		IP:        defaultPodGw6,
+	})
+}
+
+// getDefaultGatewayInterface 和ycnid一样，默认路由所在的网卡就是出口网卡
+func getDefaultGatewayInterface() (*net.Interface, error) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get routes")
+		}
+		for _, route := range routes {
+			if route.Dst == nil || route.Dst.String() == "0.0.0.0/0" || route.Dst.String() == "::/0" {
+				if route.LinkIndex <= 0 {
+					continue
+				}
+				return net.InterfaceByIndex(route.LinkIndex)
+			}
+		}
+	}
+	return nil, errors.New("failed to get default gateway interface")
+}
+
+// hostVethPodIPs 从宿主机上指向hostVeth的路由中找出pod的ip
+func hostVethPodIPs(hostVethName string) ([]net.IPNet, error) {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := netlink.RouteList(hostVeth, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	var podIPs []net.IPNet
+	for _, r := range routes {
+		if r.Dst == nil || r.Dst.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		podIPs = append(podIPs, *r.Dst)
+	}
+	return podIPs, nil
 }
 
 func parseArgs(args string) *cniArgs {
@@ -44,14 +95,16 @@ func parseArgs(args string) *cniArgs {
 	attrs := strings.Split(args, ";")
 	for _, attr := range attrs {
 		kv := strings.Split(attr, "=")
-        if len(kv)!= 2 {
-            continue
-        }
-        m[kv[0]] = kv[1]
+		if len(kv) != 2 {
+			continue
+		}
+		m[kv[0]] = kv[1]
 	}
 	return &cniArgs{
-		namespace: m["K8s_POD_NAMESPACE"],
-		podName:   m["K8s_POD_NAME"],
-        containerID: m["K8s_POD_INFRA_CONTAINER_ID"],
+		namespace:   m["K8s_POD_NAMESPACE"],
+		podName:     m["K8s_POD_NAME"],
+		containerID: m["K8s_POD_INFRA_CONTAINER_ID"],
+		ip:          m["IP"],
+		routes:      m["ROUTES"],
 	}
-}
\ No newline at end of file
+}
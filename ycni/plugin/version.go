@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// supportedVersions 插件支持的cni规范版本，结果统一按1.x构造，输出时转换成配置的版本。
+// 0.1.0和0.2.0的结果里没有网卡信息，不支持
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0", "1.1.0"}
+
+const (
+	// CHECK从0.4.0开始支持
+	cniVersion040 = "0.4.0"
+	// GC和STATUS从1.1.0开始支持，网卡的mtu字段也是1.1.0加的
+	cniVersion110 = "1.1.0"
+)
+
+// versionAtLeast 配置的版本不低于min，版本号解析失败时按不满足处理
+func versionAtLeast(ycniConf *YCNIConfig, min string) bool {
+	ok, err := version.GreaterThanOrEqualTo(ycniConf.CNIVersion, min)
+	return err == nil && ok
+}
+
+// requireVersion skel分发命令前也会检查，这里保证插件自己调用时行为一致
+func requireVersion(ycniConf *YCNIConfig, min, verb string) error {
+	if versionAtLeast(ycniConf, min) {
+		return nil
+	}
+	return newCNIError(types.ErrIncompatibleCNIVersion, cniDetail(ycniConf.CNIVersion),
+		fmt.Sprintf("cni版本低于%s，不支持%s", min, verb), fmt.Sprintf("config version does not allow %s", verb))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+	"testing"
+)
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version string
+		min     string
+		want    bool
+	}{
+		{version: "0.3.0", min: cniVersion040, want: false},
+		{version: "0.3.1", min: cniVersion040, want: false},
+		{version: "0.4.0", min: cniVersion040, want: true},
+		{version: "1.0.0", min: cniVersion040, want: true},
+		{version: "1.1.0", min: cniVersion040, want: true},
+		{version: "0.4.0", min: cniVersion110, want: false},
+		{version: "1.0.0", min: cniVersion110, want: false},
+		{version: "1.1.0", min: cniVersion110, want: true},
+		{version: "", min: cniVersion040, want: false},
+		{version: "garbage", min: cniVersion040, want: false},
+		{version: "1.x", min: cniVersion040, want: false},
+	}
+	for _, tt := range tests {
+		conf := &YCNIConfig{}
+		conf.CNIVersion = tt.version
+		if got := versionAtLeast(conf, tt.min); got != tt.want {
+			t.Errorf("versionAtLeast(%q, %q) = %v, want %v", tt.version, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestRequireVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		min     string
+		wantErr bool
+	}{
+		{version: "0.3.1", min: cniVersion040, wantErr: true},
+		{version: "0.4.0", min: cniVersion040},
+		{version: "1.0.0", min: cniVersion110, wantErr: true},
+		{version: "1.1.0", min: cniVersion110},
+		{version: "garbage", min: cniVersion040, wantErr: true},
+	}
+	for _, tt := range tests {
+		conf := &YCNIConfig{}
+		conf.CNIVersion = tt.version
+		err := requireVersion(conf, tt.min, "CHECK")
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("requireVersion(%q, %q) error = %v, wantErr %v", tt.version, tt.min, err, tt.wantErr)
+		}
+		if err != nil {
+			if code := toCNIError(err).Code; code != types.ErrIncompatibleCNIVersion {
+				t.Errorf("requireVersion(%q, %q) code = %d, want %d", tt.version, tt.min, code, types.ErrIncompatibleCNIVersion)
+			}
+		}
+	}
+}
+
+func TestSupportedVersions(t *testing.T) {
+	for _, v := range []string{cniVersion040, cniVersion110} {
+		found := false
+		for _, s := range supportedVersions {
+			found = found || s == v
+		}
+		if !found {
+			t.Errorf("supportedVersions缺少%s", v)
+		}
+	}
+	for _, v := range supportedVersions {
+		if v == "0.1.0" || v == "0.2.0" {
+			t.Errorf("supportedVersions不应包含%s", v)
+		}
+	}
+}
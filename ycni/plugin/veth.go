@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 每个容器网卡对应的hostVeth名字，ADD时记录下来，DEL和CHECK直接读取，不用重新计算。
+// 升级了命名规则之后，老的容器也能按记录找到原来的veth
+const defaultVethDir = "/var/lib/cni/ycni/veth"
+
+// vethDir 和sticky一样按网络名区分
+func vethDir(ycniConf *YCNIConfig) string {
+	return filepath.Join(defaultVethDir, ycniConf.Name)
+}
+
+func vethFile(ycniConf *YCNIConfig, containerID, ifName string) string {
+	return filepath.Join(vethDir(ycniConf), attachmentKey(containerID, ifName))
+}
+
+// attachmentKey 一次挂载的唯一标识，也是hostVeth记录的文件名
+func attachmentKey(containerID, ifName string) string {
+	return containerID + "_" + ifName
+}
+
+// vethName 网卡名最长15个字符，sha1取前11位加上veth前缀
+func vethName(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%s%s", "veth", hex.EncodeToString(h.Sum(nil))[:11])
+}
+
+func vethNameForWorkload(namespace, podname string) string {
+	return vethName(fmt.Sprintf("%s.%s", namespace, podname))
+}
+
+// vethNameForAttachment 容器id加容器内网卡名唯一确定一次挂载，cnitool和podman没有k8s参数时也不会重名
+func vethNameForAttachment(containerID, ifName string) string {
+	return vethName(fmt.Sprintf("%s/%s", containerID, ifName))
+}
+
+// hostVethNameFor 优先按容器id和网卡名命名，没有容器id时退回到pod的namespace和名字
+func hostVethNameFor(args *skel.CmdArgs, cniargs *cniArgs) string {
+	if args.ContainerID != "" {
+		return vethNameForAttachment(args.ContainerID, args.IfName)
+	}
+	return vethNameForWorkload(cniargs.namespace, cniargs.podName)
+}
+
+// lookupHostVethName 读取ADD时记录的名字，没有记录时按当前规则计算
+func lookupHostVethName(ycniConf *YCNIConfig, args *skel.CmdArgs) (string, error) {
+	data, err := os.ReadFile(vethFile(ycniConf, args.ContainerID, args.IfName))
+	if err == nil {
+		if name := strings.TrimSpace(string(data)); name != "" {
+			return name, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "读取hostVeth记录失败")
+	}
+	return hostVethNameFor(args, parseArgs(args.Args)), nil
+}
+
+// findHostVethRecord 不知道网络名时在所有网络的记录里找，返回记录文件和hostVeth名，没有记录时返回空
+func findHostVethRecord(containerID, ifName string) (string, string, error) {
+	files, err := filepath.Glob(filepath.Join(defaultVethDir, "*", attachmentKey(containerID, ifName)))
+	if err != nil {
+		return "", "", errors.Wrap(err, "查找hostVeth记录失败")
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", "", errors.Wrapf(err, "读取hostVeth记录失败: %s", file)
+		}
+		if name := strings.TrimSpace(string(data)); name != "" {
+			return file, name, nil
+		}
+	}
+	return "", "", nil
+}
+
+// saveHostVethName 先写临时文件再rename，避免读到写了一半的文件
+func saveHostVethName(ycniConf *YCNIConfig, args *skel.CmdArgs, hostVethName string) error {
+	if err := os.MkdirAll(vethDir(ycniConf), 0755); err != nil {
+		return errors.Wrap(err, "创建hostVeth记录目录失败")
+	}
+	file := vethFile(ycniConf, args.ContainerID, args.IfName)
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(hostVethName), 0644); err != nil {
+		return errors.Wrapf(err, "写入hostVeth记录失败: %s", tmp)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return errors.Wrapf(err, "写入hostVeth记录失败: %s", file)
+	}
+	return nil
+}
+
+// removeHostVethName 记录不存在时不报错
+func removeHostVethName(ycniConf *YCNIConfig, args *skel.CmdArgs) error {
+	return removeHostVethRecord(ycniConf, attachmentKey(args.ContainerID, args.IfName))
+}
+
+func removeHostVethRecord(ycniConf *YCNIConfig, key string) error {
+	err := os.Remove(filepath.Join(vethDir(ycniConf), key))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "删除hostVeth记录失败")
+	}
+	return nil
+}
+
+// listHostVethNames 返回当前网络所有的hostVeth记录，key是记录的文件名，目录不存在时返回空
+func listHostVethNames(ycniConf *YCNIConfig) (map[string]string, error) {
+	entries, err := os.ReadDir(vethDir(ycniConf))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "读取hostVeth记录目录失败")
+	}
+	names := map[string]string{}
+	for _, entry := range entries {
+		// 写了一半的临时文件和正式记录是同一个veth，不单独处理
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(vethDir(ycniConf), entry.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "读取hostVeth记录失败: %s", entry.Name())
+		}
+		names[entry.Name()] = strings.TrimSpace(string(data))
+	}
+	return names, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// 通过这个环境变量选择pod的组网模式，默认是路由模式
+const modeEnv = "YCNI_MODE"
+
+const (
+	modeRouted = "routed"
+	modeBridge = "bridge"
+	// 网桥模式下每个node一个网桥，上面配置PodCIDR的网关地址
+	bridgeName = "ycnibr0"
+)
+
+// podMode 无法识别的值按路由模式处理
+func podMode() string {
+	mode := strings.TrimSpace(os.Getenv(modeEnv))
+	switch mode {
+	case modeRouted, modeBridge:
+		return mode
+	case "":
+		return modeRouted
+	default:
+		klog.Warningf("不支持的模式: %s, 使用%s", mode, modeRouted)
+		return modeRouted
+	}
+}
+
+// InitBridgeDevice 创建网桥并配置PodCIDR的网关地址，也就是子网的第一个地址，
+// 和host-local默认分配给pod的网关一致。本机的PodCIDR路由走网桥
+func InitBridgeDevice(cidr string, mtu int) (*netlink.Bridge, error) {
+	_, podCidr, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.Wrap(err, "解析cidr失败")
+	}
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, errors.Wrapf(err, "获取网桥失败: %s", bridgeName)
+		}
+		klog.Infof("网桥%s不存在，创建网桥", bridgeName)
+		if err = netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName, MTU: mtu}}); err != nil && err != syscall.EEXIST {
+			return nil, errors.Wrapf(err, "创建网桥失败: %s", bridgeName)
+		}
+		if link, err = netlink.LinkByName(bridgeName); err != nil {
+			return nil, errors.Wrapf(err, "获取网桥失败: %s", bridgeName)
+		}
+	}
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		return nil, errors.Errorf("%s不是网桥: %s", bridgeName, link.Type())
+	}
+	if br.MTU != mtu {
+		if err = netlink.LinkSetMTU(br, mtu); err != nil {
+			return nil, errors.Wrap(err, "设置网桥mtu失败")
+		}
+	}
+
+	gateway := &net.IPNet{IP: ip.NextIP(podCidr.IP), Mask: podCidr.Mask}
+	existAddrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, errors.Wrap(err, "获取网桥地址失败")
+	}
+	found := false
+	for _, addr := range existAddrs {
+		if addr.IPNet.String() == gateway.String() {
+			found = true
+			break
+		}
+	}
+	if !found {
+		if err = netlink.AddrAdd(br, &netlink.Addr{IPNet: gateway}); err != nil && err != syscall.EEXIST {
+			return nil, errors.Wrapf(err, "网桥配置地址失败: %s", gateway.String())
+		}
+	}
+	if err = netlink.LinkSetUp(br); err != nil {
+		return nil, errors.Wrap(err, "启动网桥失败")
+	}
+	// 配置地址时内核会加上直连路由，这里再显式替换一次，避免被其他组件改到别的网卡上
+	if err = netlink.RouteReplace(&netlink.Route{
+		LinkIndex: br.Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       podCidr,
+		Src:       gateway.IP,
+	}); err != nil {
+		return nil, errors.Wrapf(err, "添加PodCIDR路由失败: %s", podCidr.String())
+	}
+	return br, nil
+}
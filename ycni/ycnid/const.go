@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 const (
 	vxlanName     = "vxlan.1"
 	vxlanVNI      = 1
@@ -7,6 +9,13 @@ const (
 	encapOverhead = 50
 )
 
+// ycnid初始化完成后写入，之后定期更新修改时间，退出时删除，插件的STATUS据此判断节点是否就绪。
+// 放在/var/run下，节点重启后不会残留。ycnid异常退出时文件会留下来，插件认为修改时间太旧的文件是ycnid已经不在了
+const (
+	readyFile              = "/var/run/ycni/ready"
+	readyHeartbeatInterval = 10 * time.Second
+)
+
 const (
 	ycniVtepMacAnnotationKey = "ycni.vtep.mac"
 	ycniHostIPAnnotationKey  = "ycni.host.ip"
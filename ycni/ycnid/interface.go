@@ -0,0 +1,36 @@
+package main
+
+import (
+	"k8s.io/klog/v2"
+	"os"
+	"strings"
+)
+
+// 通过这个环境变量选择pod网卡的类型，默认是veth
+const interfaceTypeEnv = "YCNI_INTERFACE_TYPE"
+
+const (
+	ifTypeVeth    = "veth"
+	ifTypeIPVlan  = "ipvlan"
+	ifTypeMacvlan = "macvlan"
+)
+
+// podInterfaceType ipvlan和macvlan建在出口网卡上，网桥模式下只能用veth，无法识别的值按veth处理
+func podInterfaceType(mode string) string {
+	ifType := strings.TrimSpace(os.Getenv(interfaceTypeEnv))
+	switch ifType {
+	case "":
+		return ifTypeVeth
+	case ifTypeVeth:
+		return ifType
+	case ifTypeIPVlan, ifTypeMacvlan:
+		if mode == modeBridge {
+			klog.Warningf("网桥模式不支持%s, 使用%s", ifType, ifTypeVeth)
+			return ifTypeVeth
+		}
+		return ifType
+	default:
+		klog.Warningf("不支持的网卡类型: %s, 使用%s", ifType, ifTypeVeth)
+		return ifTypeVeth
+	}
+}
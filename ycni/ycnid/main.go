@@ -22,6 +22,10 @@ import (
 )
 
 func main() {
+	// 上次异常退出时留下的就绪文件要先删掉，初始化完成前STATUS要返回未就绪
+	if err := os.Remove(readyFile); err != nil && !os.IsNotExist(err) {
+		klog.Fatalf("删除就绪文件失败: %s", err.Error())
+	}
 	// 获取当前所在node
 	stopChan := signals.SetupSignalHandler()
 	cfg, err := clientcmd.BuildConfigFromFlags("", "/etc/kubernetes/kubelet.conf")
@@ -49,13 +53,34 @@ func main() {
 		klog.Fatalf("node: %s, node.Spec.PodCIDR为空", node.Name)
 	}
 	klog.Infof("获取node信息成功: %+v", node)
-	// 初始化cni插件所需配置文件
+	// 默认路由所在的网卡作为pod出方向的网卡
+	gateway, err := getDefaultGatewayInterface()
+	if err != nil {
+		klog.Fatalf("获取路由出口网卡失败: %s", err.Error())
+	}
+	// pod的mtu要扣掉vxlan封装的开销，否则跨node的包会超过底层网卡mtu被丢弃
+	podMTU := gateway.MTU - encapOverhead
+	// 初始化cni插件所需配置文件，cniVersion用容器运行时支持的最高版本
+	cniVersion := cniVersionForRuntime(node.Status.NodeInfo.ContainerRuntimeVersion)
+	klog.Infof("容器运行时: %s, cniVersion: %s", node.Status.NodeInfo.ContainerRuntimeVersion, cniVersion)
+	mode := podMode()
+	ifType := podInterfaceType(mode)
+	klog.Infof("组网模式: %s, pod网卡类型: %s", mode, ifType)
+	// statefulset的pod保留ip，只有清理保留记录的informer同步成功后才开启
+	stickyIPs := false
+	if stickyIPsEnabled() {
+		if err = startStickyGC(stopChan); err != nil {
+			klog.Errorf("启动ip保留记录清理失败, 不开启stickyIPs: %s", err.Error())
+		} else {
+			stickyIPs = true
+		}
+	}
 	fd, err := os.OpenFile("/etc/cni/net.d/00-ycni.conf", os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.ModeAppend|os.ModePerm)
 	if err != nil {
 		klog.Fatalf("打开/etc/cni/net.d/00-ycni.conf失败: %s", err.Error())
 	}
 	defer fd.Close()
-	_, err = fd.Write([]byte(fmt.Sprintf(cniConfTemplate, node.Spec.PodCIDR)))
+	_, err = fd.Write([]byte(fmt.Sprintf(cniConfTemplate, cniVersion, podMTU, mode, bridgeName, ifType, gateway.Name, vxlanName, readyFile, stickyIPs, node.Spec.PodCIDR)))
 	if err != nil {
 		klog.Fatalf("写入/etc/cni/net.d/00-ycni.conf失败: %s", err.Error())
 	}
@@ -66,6 +91,17 @@ func main() {
 	if err != nil {
 		klog.Fatalf("初始化vxlan失败: %s", err.Error())
 	}
+	// 网桥模式下本机PodCIDR的路由走网桥，网桥上的网关地址作为pod的默认网关
+	if mode == modeBridge {
+		if _, err = InitBridgeDevice(node.Spec.PodCIDR, podMTU); err != nil {
+			klog.Fatalf("初始化网桥失败: %s", err.Error())
+		}
+	}
+	// 开启转发等节点级别的sysctl，vxlan设备建好后才能设置它的rp_filter
+	if err = applyNodeSysctls(); err != nil {
+		klog.Fatalf("设置节点sysctl失败: %s", err.Error())
+	}
+	go runSysctlWatch(stopChan)
 	// 上传本机vxlan信息
 	newNode := node.DeepCopy()
 
@@ -105,8 +141,16 @@ func main() {
 			UpdateFunc: updateFunc(vxlanDevice),
 		},
 	})
+	if err = writeReadyFile(); err != nil {
+		klog.Fatalf("写入就绪文件失败: %s", err.Error())
+	}
+	go runReadyHeartbeat(stopChan)
 	klog.Infof("启动ycni成功")
 	<-stopChan
+	// 退出后插件的STATUS返回未就绪，kubelet不再创建pod
+	if err = os.Remove(readyFile); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("删除就绪文件失败: %s", err.Error())
+	}
 }
 
 func InitVxlanDevice(cidr string) (*netlink.Vxlan, error) {
@@ -143,6 +187,13 @@ func InitVxlanDevice(cidr string) (*netlink.Vxlan, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "创建vxlan失败")
 	}
+	// 已存在的vxlan设备mtu可能是旧的，比如底层网卡mtu改过
+	if mtu := gateway.MTU - encapOverhead; vxlan.MTU != mtu {
+		if err = netlink.LinkSetMTU(vxlan, mtu); err != nil {
+			return nil, errors.Wrap(err, "设置vxlan mtu失败")
+		}
+		vxlan.MTU = mtu
+	}
 
 	// 给vxlan设备配置地址
 	_, podCidr, err := net.ParseCIDR(cidr)
@@ -197,8 +248,23 @@ func GetCurrentNode(clientSet *kubernetes.Clientset, nodeLister v13.NodeLister)
 
 var cniConfTemplate = `{
   "name": "ycni0",
-  "cniVersion": "0.3.1",
+  "cniVersion": "%s",
   "type": "ycni",
+  "mtu": %d,
+  "mode": "%s",
+  "bridge": "%s",
+  "interfaceType": "%s",
+  "outInterface": "%s",
+  "overlayDevice": "%s",
+  "readyFile": "%s",
+  "kubeconfig": "/etc/kubernetes/kubelet.conf",
+  "stickyIPs": %t,
+  "capabilities": {
+    "ips": true,
+    "dns": true,
+    "bandwidth": true,
+    "portMappings": true
+  },
   "ipam": {
     "type": "host-local",
     "subnet": "%s"
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	v13 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// 开启后插件给statefulset的pod保留ip，默认关闭。保留记录要靠ycnid清理，清理起不来时不会开启
+const stickyIPsEnv = "YCNI_STICKY_IPS"
+
+// statefulset pod的ip保留记录由插件写在stickyDir/<网络名>/下，
+// ycnid在statefulset或pvc被删除后清理，文件格式和插件保持一致
+const (
+	stickyDir        = "/var/lib/cni/ycni/sticky"
+	stickyGCInterval = time.Minute
+	// 刚写入的记录对应的statefulset可能还没同步到informer里，先不清理
+	stickyGracePeriod = 5 * time.Minute
+	// 没有权限或者连不上apiserver时缓存一直同步不完，超时后放弃
+	stickySyncTimeout = 2 * time.Minute
+)
+
+type stickyReservation struct {
+	Namespace      string   `json:"namespace"`
+	PodName        string   `json:"podName"`
+	StatefulSet    string   `json:"statefulSet"`
+	StatefulSetUID string   `json:"statefulSetUID"`
+	PVCs           []string `json:"pvcs,omitempty"`
+	IPs            []string `json:"ips"`
+}
+
+func stickyIPsEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(stickyIPsEnv))
+	return enabled
+}
+
+// startStickyGC 用ServiceAccount的凭据监控statefulset和pvc，kubelet.conf里的节点身份没有权限list/watch它们。
+// 缓存同步完成后在后台清理失效的ip保留记录，返回错误时不能开启stickyIPs，否则保留的ip永远不会释放
+func startStickyGC(stopChan <-chan struct{}) error {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return errors.Wrap(err, "获取ServiceAccount配置失败")
+	}
+	clientSet, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return errors.Wrap(err, "创建clientset失败")
+	}
+	factory := informers.NewSharedInformerFactory(clientSet, 0)
+	stsInformer := factory.Apps().V1().StatefulSets().Informer()
+	pvcInformer := factory.Core().V1().PersistentVolumeClaims().Informer()
+
+	// 同步失败时停掉informer，不在后台一直重试
+	informerStop := make(chan struct{})
+	go stsInformer.Run(informerStop)
+	go pvcInformer.Run(informerStop)
+	ctx, cancel := context.WithTimeout(context.Background(), stickySyncTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), stsInformer.HasSynced, pvcInformer.HasSynced) {
+		close(informerStop)
+		return errors.Errorf("等待statefulset和pvc缓存同步失败, 检查ServiceAccount的权限: %v", ctx.Err())
+	}
+	go func() {
+		<-stopChan
+		close(informerStop)
+	}()
+
+	go runStickyGC(factory, stsInformer, pvcInformer, stopChan)
+	return nil
+}
+
+// runStickyGC 监控statefulset和pvc的删除事件并定期清理失效的ip保留记录
+func runStickyGC(factory informers.SharedInformerFactory, stsInformer, pvcInformer cache.SharedIndexInformer, stopChan <-chan struct{}) {
+	stsLister := factory.Apps().V1().StatefulSets().Lister()
+	pvcLister := factory.Core().V1().PersistentVolumeClaims().Lister()
+
+	gc := func() {
+		gcStickyReservations(stsLister, pvcLister)
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			gc()
+		},
+	}
+	stsInformer.AddEventHandler(handler)
+	pvcInformer.AddEventHandler(handler)
+	wait.Until(gc, stickyGCInterval, stopChan)
+}
+
+func gcStickyReservations(stsLister appslisters.StatefulSetLister, pvcLister v13.PersistentVolumeClaimLister) {
+	files, err := filepath.Glob(filepath.Join(stickyDir, "*", "*.json"))
+	if err != nil {
+		klog.Errorf("读取ip保留记录失败: %s", err.Error())
+		return
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || time.Since(info.ModTime()) < stickyGracePeriod {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		r := &stickyReservation{}
+		if err = json.Unmarshal(data, r); err != nil {
+			klog.Warningf("ip保留记录格式错误: %s: %s", file, err.Error())
+			continue
+		}
+		reason := stickyReleaseReason(r, stsLister, pvcLister)
+		if reason == "" {
+			continue
+		}
+		if err = os.Remove(file); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("删除ip保留记录失败: %s: %s", file, err.Error())
+			continue
+		}
+		klog.Infof("清理ip保留记录: %s/%s %v, %s", r.Namespace, r.PodName, r.IPs, reason)
+	}
+}
+
+// stickyReleaseReason 返回需要清理的原因，不需要清理时返回空，查询出错时保留记录
+func stickyReleaseReason(r *stickyReservation, stsLister appslisters.StatefulSetLister, pvcLister v13.PersistentVolumeClaimLister) string {
+	sts, err := stsLister.StatefulSets(r.Namespace).Get(r.StatefulSet)
+	if apierrors.IsNotFound(err) {
+		return "statefulset已删除"
+	}
+	if err != nil {
+		return ""
+	}
+	if string(sts.UID) != r.StatefulSetUID {
+		return "statefulset已重建"
+	}
+	for _, pvc := range r.PVCs {
+		if _, err = pvcLister.PersistentVolumeClaims(r.Namespace).Get(pvc); apierrors.IsNotFound(err) {
+			return "pvc已删除: " + pvc
+		}
+	}
+	return ""
+}
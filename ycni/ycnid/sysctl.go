@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 容器里的/proc/sys是只读的，把宿主机的/proc/sys/net挂载到这里，直接在宿主机上运行时用/proc/sys
+	hostProcSys = "/host/proc/sys"
+	// 定期检查节点的sysctl，被其他程序改掉后重新设置
+	sysctlInterval = 30 * time.Second
+)
+
+// nodeSysctl key是/proc/sys下的相对路径，vxlan.1这种带点的网卡名不能用点分隔
+type nodeSysctl struct {
+	key   string
+	value string
+	// 只在当前值更小时设置，不覆盖管理员调大的值
+	atLeast bool
+}
+
+// nodeSysctls 节点上需要的sysctl: 转发、vxlan设备的反向路径检查和邻居表大小，
+// 每个节点上的pod和跨节点的vtep都会占用邻居表，默认的gc阈值太小
+func nodeSysctls() []nodeSysctl {
+	sysctls := []nodeSysctl{
+		{key: "net/ipv4/ip_forward", value: "1"},
+		{key: "net/ipv6/conf/all/forwarding", value: "1"},
+		// 生效的是all和网卡配置中较大的值，2是宽松模式
+		{key: "net/ipv4/conf/" + vxlanName + "/rp_filter", value: "2"},
+	}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		sysctls = append(sysctls,
+			nodeSysctl{key: "net/" + family + "/neigh/default/gc_thresh1", value: "1024", atLeast: true},
+			nodeSysctl{key: "net/" + family + "/neigh/default/gc_thresh2", value: "4096", atLeast: true},
+			nodeSysctl{key: "net/" + family + "/neigh/default/gc_thresh3", value: "8192", atLeast: true},
+		)
+	}
+	return sysctls
+}
+
+func procSysDir() string {
+	if _, err := os.Stat(filepath.Join(hostProcSys, "net")); err == nil {
+		return hostProcSys
+	}
+	return "/proc/sys"
+}
+
+// applyNodeSysctls 设置和期望不一致的sysctl，返回遇到的第一个错误
+func applyNodeSysctls() error {
+	dir := procSysDir()
+	var firstErr error
+	for _, s := range nodeSysctls() {
+		path := filepath.Join(dir, s.key)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// 节点没有开启ipv6时没有对应的文件
+			if os.IsNotExist(err) && strings.Contains(s.key, "ipv6") {
+				continue
+			}
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "读取%s失败", s.key)
+			}
+			continue
+		}
+		current := strings.TrimSpace(string(data))
+		if current == s.value {
+			continue
+		}
+		if s.atLeast {
+			cur, err1 := strconv.Atoi(current)
+			want, err2 := strconv.Atoi(s.value)
+			if err1 == nil && err2 == nil && cur >= want {
+				continue
+			}
+		}
+		klog.Infof("设置sysctl %s: %s -> %s", s.key, current, s.value)
+		if err = os.WriteFile(path, []byte(s.value), 0644); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "设置%s失败", s.key)
+		}
+	}
+	return firstErr
+}
+
+// runSysctlWatch 定期把节点的sysctl恢复成期望值
+func runSysctlWatch(stopChan <-chan struct{}) {
+	wait.Until(func() {
+		if err := applyNodeSysctls(); err != nil {
+			klog.Errorf("设置节点sysctl失败: %s", err.Error())
+		}
+	}, sysctlInterval, stopChan)
+}
@@ -4,10 +4,14 @@ import (
 	"crypto/rand"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func newHardwareAddr() (net.HardwareAddr, error) {
@@ -75,3 +79,27 @@ func ensureVxlan(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 
 	return link.(*netlink.Vxlan), nil
 }
+
+// writeReadyFile vxlan和节点信息都准备好之后调用，文件已经存在时更新修改时间
+func writeReadyFile() error {
+	if err := os.MkdirAll(filepath.Dir(readyFile), 0755); err != nil {
+		return errors.Wrap(err, "创建就绪文件目录失败")
+	}
+	if err := os.WriteFile(readyFile, nil, 0644); err != nil {
+		return errors.Wrap(err, "写入就绪文件失败")
+	}
+	now := time.Now()
+	if err := os.Chtimes(readyFile, now, now); err != nil {
+		return errors.Wrap(err, "更新就绪文件失败")
+	}
+	return nil
+}
+
+// runReadyHeartbeat 定期更新就绪文件的修改时间，ycnid挂掉后插件根据修改时间判断未就绪
+func runReadyHeartbeat(stopChan <-chan struct{}) {
+	wait.Until(func() {
+		if err := writeReadyFile(); err != nil {
+			klog.Errorf("更新就绪文件失败: %s", err.Error())
+		}
+	}, readyHeartbeatInterval, stopChan)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 生成配置时可以用这个环境变量指定cniVersion，不再按容器运行时推断
+const cniVersionEnv = "YCNI_CNI_VERSION"
+
+// 无法识别运行时的时候使用，0.4.0之前的版本不支持CHECK
+const defaultCNIVersion = "0.4.0"
+
+// runtimeCNIVersions 各容器运行时从哪个版本开始支持对应的cni规范，按版本从高到低排列。
+// containerd 2.0和cri-o 1.31开始使用支持GC和STATUS的libcni
+var runtimeCNIVersions = map[string][]struct {
+	major, minor int
+	cniVersion   string
+}{
+	"containerd": {
+		{2, 0, "1.1.0"},
+		{1, 7, "1.0.0"},
+		{1, 4, "0.4.0"},
+	},
+	"cri-o": {
+		{1, 31, "1.1.0"},
+		{1, 23, "1.0.0"},
+		{1, 17, "0.4.0"},
+	},
+}
+
+// cniVersionForRuntime 按node上报的容器运行时版本选择它支持的最高cni版本，
+// runtimeVersion形如containerd://1.7.13或者cri-o://1.29.1
+func cniVersionForRuntime(runtimeVersion string) string {
+	if v := os.Getenv(cniVersionEnv); v != "" {
+		return v
+	}
+	name, ver, found := strings.Cut(runtimeVersion, "://")
+	if !found {
+		return defaultCNIVersion
+	}
+	major, minor, ok := parseMajorMinor(ver)
+	if !ok {
+		return defaultCNIVersion
+	}
+	for _, r := range runtimeCNIVersions[name] {
+		if major > r.major || (major == r.major && minor >= r.minor) {
+			return r.cniVersion
+		}
+	}
+	return defaultCNIVersion
+}
+
+// parseMajorMinor 只关心主次版本号，v前缀和后面的补丁号、预发布标记都忽略
+func parseMajorMinor(ver string) (int, int, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(ver, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	// 1.7.13-rc.1这种只有两段时次版本号后面可能跟着预发布标记
+	minorStr := parts[1]
+	if i := strings.IndexFunc(minorStr, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minorStr = minorStr[:i]
+	}
+	minor, err := strconv.Atoi(minorStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
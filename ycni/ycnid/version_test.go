@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestParseMajorMinor(t *testing.T) {
+	tests := []struct {
+		ver          string
+		major, minor int
+		ok           bool
+	}{
+		{ver: "1.7.13", major: 1, minor: 7, ok: true},
+		{ver: "v2.0.0", major: 2, minor: 0, ok: true},
+		{ver: "1.29.1-rc.1", major: 1, minor: 29, ok: true},
+		{ver: "1.7-rc.1", major: 1, minor: 7, ok: true},
+		{ver: "1.31", major: 1, minor: 31, ok: true},
+		{ver: "1", ok: false},
+		{ver: "", ok: false},
+		{ver: "x.7.1", ok: false},
+		{ver: "1.x", ok: false},
+		{ver: "garbage", ok: false},
+	}
+	for _, tt := range tests {
+		major, minor, ok := parseMajorMinor(tt.ver)
+		if ok != tt.ok || major != tt.major || minor != tt.minor {
+			t.Errorf("parseMajorMinor(%q) = %d, %d, %v, want %d, %d, %v", tt.ver, major, minor, ok, tt.major, tt.minor, tt.ok)
+		}
+	}
+}
+
+func TestCNIVersionForRuntime(t *testing.T) {
+	// 环境变量会覆盖推断结果
+	t.Setenv(cniVersionEnv, "")
+	tests := []struct {
+		runtime string
+		want    string
+	}{
+		{runtime: "containerd://2.0.1", want: "1.1.0"},
+		{runtime: "containerd://2.1.0", want: "1.1.0"},
+		{runtime: "containerd://1.7.13", want: "1.0.0"},
+		{runtime: "containerd://1.6.28", want: "0.4.0"},
+		{runtime: "containerd://1.4.0", want: "0.4.0"},
+		{runtime: "containerd://1.3.9", want: defaultCNIVersion},
+		{runtime: "cri-o://1.31.0", want: "1.1.0"},
+		{runtime: "cri-o://1.29.1", want: "1.0.0"},
+		{runtime: "cri-o://1.23.0", want: "1.0.0"},
+		{runtime: "cri-o://1.22.5", want: "0.4.0"},
+		{runtime: "cri-o://1.16.0", want: defaultCNIVersion},
+		{runtime: "docker://24.0.7", want: defaultCNIVersion},
+		{runtime: "containerd://garbage", want: defaultCNIVersion},
+		{runtime: "containerd", want: defaultCNIVersion},
+		{runtime: "", want: defaultCNIVersion},
+	}
+	for _, tt := range tests {
+		if got := cniVersionForRuntime(tt.runtime); got != tt.want {
+			t.Errorf("cniVersionForRuntime(%q) = %s, want %s", tt.runtime, got, tt.want)
+		}
+	}
+}
+
+func TestCNIVersionForRuntimeEnv(t *testing.T) {
+	t.Setenv(cniVersionEnv, "0.3.1")
+	if got := cniVersionForRuntime("containerd://2.0.0"); got != "0.3.1" {
+		t.Errorf("cniVersionForRuntime() = %s, want 0.3.1", got)
+	}
+}